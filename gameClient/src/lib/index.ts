@@ -1 +1,4 @@
 // place files you want to import through the `$lib` alias in this folder.
+
+// Phiên bản giao thức gửi trong tin nhắn init; server trả lỗi UNSUPPORTED_VERSION nếu không hỗ trợ
+export const PROTOCOL_VERSION = 1;
@@ -2,8 +2,9 @@
 import { writable } from "svelte/store";
 
 export interface User {
-  id: string;
+  id: string; // Do server cấp khi đăng nhập
   username: string;
+  token: string; // Session token gửi kèm khi kết nối WebSocket (?token=...)
 }
 
 const initialUser: User | null = null;
@@ -1,7 +1,8 @@
 import { get } from "svelte/store";
 import { currentUser } from "$lib/stores/currentUser";
+import { PROTOCOL_VERSION } from "$lib";
 import type { User } from "$lib/stores/currentUser";
-import { messages, playersStore, numOfPlayers } from "./store";
+import { messages, playersStore, numOfPlayers, leaderboard } from "./store";
 
 const NUM_CELLS = 30;
 const CANVAS_SIZE = 600; // Kích thước canvas tổng thể
@@ -13,6 +14,8 @@ let ctx: CanvasRenderingContext2D | null;
 // let players: any = {}; // Không cần biến cục bộ này nữa nếu dùng store
 let foods: any = [];
 let userID: string = "";
+// Số thứ tự tick của state cuối cùng, null khi đang chờ keyframe
+let lastSeq: number | null = null;
 
 let socket: WebSocket | null = null; // Khởi tạo là null
 
@@ -53,7 +56,9 @@ export function initializeGame(canvasElement: HTMLCanvasElement) {
   userID = user.id;
 
   // Tạo kết nối WebSocket mới
-  socket = new WebSocket("ws://localhost:8080/snake");
+  socket = new WebSocket(
+    `ws://localhost:8080/snake?token=${encodeURIComponent(user.token)}`
+  );
 
   // WebSocket event handlers
   socket.onopen = () => {
@@ -61,8 +66,20 @@ export function initializeGame(canvasElement: HTMLCanvasElement) {
     messages.set(["Connected to server."]); // Reset messages on new connection
     numOfPlayers.set(0);
     playersStore.set({});
-    // Send userID to server on connection
-    socket?.send(JSON.stringify({ type: "init", playerId: userID }));
+    lastSeq = null;
+    fetch("http://localhost:8080/snake/leaderboard")
+      .then((res) => res.json())
+      .then((board) => leaderboard.set(board.entries || []))
+      .catch((error) => console.error("Failed to load leaderboard:", error));
+    // Server lấy player ID từ token, chỉ cần gửi init
+    // "delta": server gửi keyframe định kỳ và gameDelta ở giữa
+    socket?.send(
+      JSON.stringify({
+        type: "init",
+        version: PROTOCOL_VERSION,
+        capabilities: ["delta"],
+      })
+    );
   };
 
   socket.onmessage = (event) => {
@@ -73,7 +90,19 @@ export function initializeGame(canvasElement: HTMLCanvasElement) {
         // players = data.players; // Cập nhật store thay vì biến cục bộ
         playersStore.set(data.players || {}); // Cập nhật store người chơi
         foods = data.foods || []; // Cập nhật food
+        lastSeq = data.seq;
         draw(); // Vẽ lại game state
+      } else if (data.type === "gameDelta") {
+        if (lastSeq === null) return; // Đã yêu cầu keyframe, bỏ qua delta
+        if (data.seq !== lastSeq + 1) {
+          // Mất delta: yêu cầu keyframe mới thay vì vẽ sai
+          lastSeq = null;
+          socket?.send(JSON.stringify({ type: "keyframe" }));
+          return;
+        }
+        applyDelta(data);
+        lastSeq = data.seq;
+        draw();
       } else if (data.type === "playerJoinedOrLeave") {
         // Cập nhật messages và số người chơi từ store
         messages.update((currentMessages) => [
@@ -81,6 +110,19 @@ export function initializeGame(canvasElement: HTMLCanvasElement) {
           ...(data.message || []),
         ]);
         numOfPlayers.set(data.totalPlayer ?? 0);
+      } else if (data.type === "leaderboard") {
+        // Một lượt chơi vừa lọt vào bảng điểm cao
+        if (data.period === "all") leaderboard.set(data.entries || []);
+        const entry = (data.entries || []).find(
+          (e: any) => e.playerId === data.playerId
+        );
+        if (entry) {
+          const who = data.playerId === userID ? "You" : entry.name;
+          messages.update((m) => [
+            ...m,
+            `${who} reached #${entry.rank} on the ${data.period} leaderboard with ${entry.score} pts!`,
+          ]);
+        }
       } else if (data.type === "error") {
         console.error("Server error:", data.message);
         messages.update((m) => [...m, `Server Error: ${data.message}`]);
@@ -110,6 +152,32 @@ export function initializeGame(canvasElement: HTMLCanvasElement) {
   window.addEventListener("keydown", handleKeydown);
 }
 
+// Áp dụng gameDelta theo thứ tự server quy định
+function applyDelta(delta: any) {
+  playersStore.update((players) => {
+    for (const id of delta.left || []) delete players[id];
+    for (const player of [...(delta.joined || []), ...(delta.reset || [])]) {
+      players[player.id] = player;
+    }
+    for (const move of delta.moves || []) {
+      const player = players[move.id];
+      if (!player) continue;
+      player.body.unshift(move.head);
+      if (move.tailRemoved) {
+        player.body.pop();
+      } else {
+        player.score++; // Rắn dài ra nghĩa là vừa ăn
+      }
+    }
+    return players;
+  });
+  for (const food of delta.foodsRemoved || []) {
+    const i = foods.findIndex((f: any) => f.x === food.x && f.y === food.y);
+    if (i !== -1) foods.splice(i, 1);
+  }
+  foods.push(...(delta.foodsAdded || []));
+}
+
 function draw() {
   if (!ctx) return;
   ctx.clearRect(0, 0, canvas.width, canvas.height);
@@ -5,3 +5,6 @@ export const messages = writable<string[]>([]);
 export const numOfPlayers = writable<number>(0);
 
 export const playersStore = writable<Record<string, any>>({});
+
+// Bảng điểm cao mọi thời đại (period "all") do server gửi
+export const leaderboard = writable<any[]>([]);
@@ -0,0 +1,282 @@
+// Package admin serves the /admin API used to inspect and moderate live
+// games. Every request must carry the configured bearer token.
+//
+//	GET  /admin/games                                   games, rooms and players
+//	POST /admin/games/{game}/rooms                      create a room, rule
+//	                                                    overrides as query,
+//	                                                    e.g. ?numCells=60
+//	GET  /admin/games/{game}/rooms/{room}               players and game state
+//	POST /admin/games/{game}/rooms/{room}/kick/{player} disconnect a player
+//	POST /admin/games/{game}/rooms/{room}/mute/{player} mute a player in chat,
+//	                                                    ?for=10m (default)
+//	POST /admin/games/{game}/rooms/{room}/unmute/{player}
+//	POST /admin/games/{game}/rooms/{room}/{command}     e.g. caro "reset",
+//	                                                    graph "clearMonsters"
+//	GET  /admin/players/{player}                        profile and results
+//	GET  /admin/health                                  health of every room
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/simplegameserver/gameserver/game"
+	"github.com/simplegameserver/gameserver/storage"
+)
+
+// defaultMute is how long a player is muted when the request does not say.
+const defaultMute = 10 * time.Minute
+
+type handler struct {
+	games *game.Registry
+	store storage.Storage
+	token []byte
+	log   *slog.Logger
+}
+
+// RoomInfo describes one room.
+type RoomInfo struct {
+	ID      string   `json:"id"`
+	Players []string `json:"players"`
+	State   any      `json:"state,omitempty"`
+}
+
+// GameInfo describes one game and its rooms.
+type GameInfo struct {
+	Name  string     `json:"name"`
+	Rooms []RoomInfo `json:"rooms"`
+}
+
+// PlayerInfo is the profile of a player and the results saved for them.
+type PlayerInfo struct {
+	storage.Player
+	CaroGames     []storage.CaroGame     `json:"caroGames"`
+	SnakeRuns     []storage.SnakeRun     `json:"snakeRuns"`
+	GraphSessions []storage.GraphSession `json:"graphSessions"`
+}
+
+// New returns the /admin API for games and the players in store,
+// authenticated with token.
+func New(games *game.Registry, store storage.Storage, token string) http.Handler {
+	h := &handler{
+		games: games,
+		store: store,
+		token: []byte(token),
+		log:   slog.With("component", "admin"),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/games", h.listGames)
+	mux.HandleFunc("POST /admin/games/{game}/rooms", h.createRoom)
+	mux.HandleFunc("GET /admin/games/{game}/rooms/{room}", h.getRoom)
+	mux.HandleFunc("POST /admin/games/{game}/rooms/{room}/kick/{player}", h.kick)
+	mux.HandleFunc("POST /admin/games/{game}/rooms/{room}/mute/{player}", h.mute)
+	mux.HandleFunc("POST /admin/games/{game}/rooms/{room}/unmute/{player}", h.unmute)
+	mux.HandleFunc("POST /admin/games/{game}/rooms/{room}/{command}", h.command)
+	mux.HandleFunc("GET /admin/players/{player}", h.getPlayer)
+	mux.HandleFunc("GET /admin/health", h.health)
+	return h.authenticate(mux)
+}
+
+func (h *handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), h.token) != 1 {
+			h.log.Warn("unauthorized admin request", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *handler) listGames(w http.ResponseWriter, r *http.Request) {
+	games := []GameInfo{}
+	for _, m := range h.games.Managers() {
+		info := GameInfo{Name: m.Name(), Rooms: []RoomInfo{}}
+		for _, room := range m.Rooms() {
+			info.Rooms = append(info.Rooms, RoomInfo{ID: room.ID, Players: players(room.Game)})
+		}
+		games = append(games, info)
+	}
+	writeJSON(w, http.StatusOK, games)
+}
+
+// createRoom makes a room with the rules overridden by the query
+// parameters. Nobody but an admin may change the rules of a room; players
+// join it by its ID within a minute, or it is destroyed.
+func (h *handler) createRoom(w http.ResponseWriter, r *http.Request) {
+	m, ok := h.games.Get(r.PathValue("game"))
+	if !ok {
+		http.Error(w, "game not found", http.StatusNotFound)
+		return
+	}
+	overrides := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		if len(v) > 0 {
+			overrides[k] = v[0]
+		}
+	}
+	room, err := m.Create(overrides)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.log.Info("room created", "game", m.Name(), "room", room.ID, "overrides", overrides)
+	writeJSON(w, http.StatusCreated, RoomInfo{ID: room.ID, Players: []string{}})
+}
+
+func (h *handler) getRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, RoomInfo{
+		ID:      room.ID,
+		Players: players(room.Game),
+		State:   room.Game.Snapshot(),
+	})
+}
+
+func (h *handler) kick(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+	mod, ok := room.Game.(game.Moderator)
+	if !ok {
+		http.Error(w, "game cannot be moderated", http.StatusNotImplemented)
+		return
+	}
+	playerID := r.PathValue("player")
+	if !mod.Kick(playerID) {
+		http.Error(w, "player not found", http.StatusNotFound)
+		return
+	}
+	h.log.Info("player kicked", "game", r.PathValue("game"), "room", room.ID, "player_id", playerID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) mute(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+	d := defaultMute
+	if s := r.URL.Query().Get("for"); s != "" {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil || d <= 0 {
+			http.Error(w, "for must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+	playerID := r.PathValue("player")
+	room.Mutes.Mute(playerID, d)
+	h.log.Info("player muted", "game", r.PathValue("game"), "room", room.ID, "player_id", playerID, "for", d)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) unmute(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+	playerID := r.PathValue("player")
+	if !room.Mutes.Unmute(playerID) {
+		http.Error(w, "player not muted", http.StatusNotFound)
+		return
+	}
+	h.log.Info("player unmuted", "game", r.PathValue("game"), "room", room.ID, "player_id", playerID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) command(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+	mod, ok := room.Game.(game.Moderator)
+	if !ok {
+		http.Error(w, "game cannot be moderated", http.StatusNotImplemented)
+		return
+	}
+	command := r.PathValue("command")
+	if err := mod.Command(command); err != nil {
+		if errors.Is(err, game.ErrUnknownCommand) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.log.Info("command run", "game", r.PathValue("game"), "room", room.ID, "command", command)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) getPlayer(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("player")
+	profile, err := h.store.Player(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "player not found", http.StatusNotFound)
+		return
+	}
+	info := PlayerInfo{Player: profile}
+	if err == nil {
+		info.CaroGames, err = h.store.CaroGames(id)
+	}
+	if err == nil {
+		info.SnakeRuns, err = h.store.SnakeRuns(id, time.Time{})
+	}
+	if err == nil {
+		info.GraphSessions, err = h.store.GraphSessions(id)
+	}
+	if err != nil {
+		h.log.Error("load player", "player_id", id, "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (h *handler) health(w http.ResponseWriter, r *http.Request) {
+	games := []game.GameStatus{}
+	for _, m := range h.games.Managers() {
+		games = append(games, m.Status())
+	}
+	writeJSON(w, http.StatusOK, games)
+}
+
+// room looks up the room named in the request path, answering 404 if it
+// does not exist.
+func (h *handler) room(w http.ResponseWriter, r *http.Request) (*game.Room, bool) {
+	m, ok := h.games.Get(r.PathValue("game"))
+	if !ok {
+		http.Error(w, "game not found", http.StatusNotFound)
+		return nil, false
+	}
+	room, ok := m.Get(r.PathValue("room"))
+	if !ok {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return nil, false
+	}
+	return room, true
+}
+
+func players(g game.Game) []string {
+	if mod, ok := g.(game.Moderator); ok {
+		return mod.Players()
+	}
+	return []string{}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
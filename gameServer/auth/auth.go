@@ -0,0 +1,119 @@
+// Package auth issues and verifies the signed session tokens players use to
+// connect to a game. The player ID is chosen by the server at login and
+// carried in the token, so a client cannot connect as another player.
+//
+// A token is base64url(JSON session) + "." + base64url(HMAC-SHA256).
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/simplegameserver/gameserver/config"
+)
+
+var (
+	ErrMissingToken = errors.New("missing session token")
+	ErrInvalidToken = errors.New("invalid session token")
+	ErrExpiredToken = errors.New("session token expired")
+)
+
+// Session identifies a logged in player.
+type Session struct {
+	PlayerID string `json:"sub"`
+	Name     string `json:"name"`
+	Expires  int64  `json:"exp"` // Unix seconds
+}
+
+// Issuer signs and verifies session tokens.
+type Issuer struct {
+	secret []byte
+	ttl    time.Duration
+	logins *loginLimiter
+}
+
+// NewIssuer creates an issuer from cfg. An empty secret is replaced by a
+// random one, so tokens do not survive a restart.
+func NewIssuer(cfg config.Auth) (*Issuer, error) {
+	secret := []byte(cfg.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return &Issuer{secret: secret, ttl: cfg.TokenTTL, logins: newLoginLimiter(cfg.LoginsPerMinute)}, nil
+}
+
+// Issue creates a session for a new player called name and returns its token.
+func (i *Issuer) Issue(name string) (string, Session, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", Session{}, err
+	}
+	s := Session{
+		PlayerID: hex.EncodeToString(id),
+		Name:     name,
+		Expires:  time.Now().Add(i.ttl).Unix(),
+	}
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return "", Session{}, err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(i.sign(payload)), s, nil
+}
+
+// Verify checks the token signature and expiry and returns its session.
+func (i *Issuer) Verify(token string) (Session, error) {
+	enc := base64.RawURLEncoding
+	p, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Session{}, ErrInvalidToken
+	}
+	payload, err := enc.DecodeString(p)
+	if err != nil {
+		return Session{}, ErrInvalidToken
+	}
+	mac, err := enc.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, i.sign(payload)) {
+		return Session{}, ErrInvalidToken
+	}
+
+	var s Session
+	if err := json.Unmarshal(payload, &s); err != nil || s.PlayerID == "" {
+		return Session{}, ErrInvalidToken
+	}
+	if time.Now().Unix() >= s.Expires {
+		return Session{}, ErrExpiredToken
+	}
+	return s, nil
+}
+
+// FromRequest verifies the token of a websocket handshake. Browsers cannot
+// set headers on a websocket, so the token is read from the "token" query
+// parameter, falling back to an "Authorization: Bearer" header.
+func (i *Issuer) FromRequest(r *http.Request) (Session, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if token == "" {
+		return Session{}, ErrMissingToken
+	}
+	return i.Verify(token)
+}
+
+func (i *Issuer) sign(payload []byte) []byte {
+	h := hmac.New(sha256.New, i.secret)
+	h.Write(payload)
+	return h.Sum(nil)
+}
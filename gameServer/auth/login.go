@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/simplegameserver/gameserver/storage"
+)
+
+const maxNameLength = 20
+
+type loginRequest struct {
+	Name string `json:"name"`
+}
+
+type loginResponse struct {
+	Token     string    `json:"token"`
+	PlayerID  string    `json:"playerId"`
+	Name      string    `json:"name"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// LoginHandler answers POST {"name": "..."} with a new session token and
+// saves the new player's profile to players. Clients logging in too often
+// get 429. The client calls it from another origin, so it must be wrapped
+// with game.CORS.
+func (i *Issuer) LoginHandler(players storage.Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !i.logins.allow(r, time.Now()) {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "too many logins, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		var req loginRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+			http.Error(w, "invalid login request", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+			http.Error(w, "name must be 1 to 20 characters", http.StatusBadRequest)
+			return
+		}
+
+		token, s, err := i.Issue(name)
+		if err != nil {
+			slog.Error("issue session token", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("player logged in", "player_id", s.PlayerID, "name", s.Name)
+		profile := storage.Player{ID: s.PlayerID, Name: s.Name, Created: time.Now().UTC()}
+		if err := players.SavePlayer(profile); err != nil {
+			// The session works without a profile, only the history is lost.
+			slog.Error("save player", "player_id", s.PlayerID, "err", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(loginResponse{
+			Token:     token,
+			PlayerID:  s.PlayerID,
+			Name:      s.Name,
+			ExpiresAt: time.Unix(s.Expires, 0).UTC(),
+		})
+	})
+}
+
+// loginLimiter counts the logins of each client IP in fixed one-minute
+// windows. Counts are dropped when a new window starts, so it only keeps
+// the IPs seen in the last minute.
+type loginLimiter struct {
+	limit int
+
+	mu     sync.Mutex
+	window time.Time
+	counts map[string]int
+}
+
+func newLoginLimiter(perMinute int) *loginLimiter {
+	return &loginLimiter{limit: perMinute, counts: make(map[string]int)}
+}
+
+// allow counts a login from the client of r and reports whether it is
+// within the limit.
+func (l *loginLimiter) allow(r *http.Request, now time.Time) bool {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.window) >= time.Minute {
+		l.window = now
+		l.counts = make(map[string]int)
+	}
+	if l.counts[ip] >= l.limit {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
@@ -3,28 +3,27 @@ package caro
 import (
 	"encoding/json" // Để mã hóa và giải mã dữ liệu JSON (giao tiếp với frontend)
 	"fmt"           // Để định dạng chuỗi (ví dụ: trong log và tin nhắn)
-	"log"           // Để ghi log các sự kiện và lỗi trên server
-	"net/http"      // Để xử lý các yêu cầu HTTP (nâng cấp lên WebSocket)
+	"log/slog"      // Để ghi log có cấu trúc các sự kiện và lỗi trên server
 	"sync"          // Để xử lý đồng bộ (sử dụng Mutex bảo vệ dữ liệu dùng chung)
 	"time"          // Để xử lý thời gian (ví dụ: đặt deadline, ticker)
 
-	"github.com/gorilla/websocket" // Thư viện WebSocket phổ biến cho Go
-)
-
-// --- Hằng số của Game ---
-const (
-	BOARD_SIZE    = 15 // Kích thước bàn cờ (15x15)
-	WIN_CONDITION = 5  // Số quân liên tiếp để thắng (5 quân)
+	"github.com/simplegameserver/gameserver/auth"     // Session token đã xác thực của người chơi
+	"github.com/simplegameserver/gameserver/chat"     // Chat của phòng: lịch sử, bộ lọc, mute
+	"github.com/simplegameserver/gameserver/config"   // Luật chơi có thể cấu hình
+	"github.com/simplegameserver/gameserver/game"     // Interface Game dùng chung cho mọi game
+	"github.com/simplegameserver/gameserver/protocol" // Router giải mã tin nhắn theo "type"
+	"github.com/simplegameserver/gameserver/storage"  // Lưu kết quả ván cờ
 )
 
 // --- Cấu trúc dữ liệu (Structs) ---
 
 // Player: Đại diện cho một người chơi trong game.
 type Player struct {
-	ID   string          `json:"id"`   // ID duy nhất của người chơi (thường là từ frontend)
-	Name string          `json:"name"` // Tên hiển thị của người chơi
-	Mark string          `json:"mark"` // Quân cờ của người chơi ("X" hoặc "O")
-	Conn *websocket.Conn `json:"-"`    // Kết nối WebSocket của người chơi (dấu "-" để không gửi thông tin này qua JSON cho frontend)
+	ID   string     `json:"id"`   // ID duy nhất của người chơi (thường là từ frontend)
+	Name string     `json:"name"` // Tên hiển thị của người chơi
+	Mark string     `json:"mark"` // Quân cờ của người chơi ("X" hoặc "O")
+	Away bool       `json:"away"` // Mất kết nối, đang giữ chỗ chờ kết nối lại
+	Conn *game.Conn `json:"-"`    // Kết nối WebSocket của người chơi (dấu "-" để không gửi thông tin này qua JSON cho frontend)
 }
 
 // Move: Đại diện cho một nước đi trên bàn cờ.
@@ -44,9 +43,9 @@ type GameState struct {
 }
 
 // InitMessage: Tin nhắn khởi tạo gửi từ frontend khi kết nối.
+// ID và tên người chơi lấy từ session token, không lấy từ tin nhắn này.
 type InitMessage struct {
-	Type   string `json:"type"`   // Phải là "init"
-	Player Player `json:"player"` // Thông tin người chơi (ID, Name) gửi từ frontend
+	Type string `json:"type"` // Phải là "init"
 }
 
 // MoveMessage: Tin nhắn chứa nước đi gửi từ frontend.
@@ -63,66 +62,118 @@ type PlayerJoinedOrLeaveMessages struct {
 	TotalPlayer int      `json:"totalPlayer"` // Tổng số người chơi hiện tại
 }
 
-// GenericMessage: Dùng để xác định loại tin nhắn đơn giản như "reset".
-type GenericMessage struct {
-	Type string `json:"type"` // Loại tin nhắn ("reset", ...)
+// --- Lỗi gửi cho client (kèm mã lỗi ổn định) ---
+var (
+	errGameNotActive = protocol.NewError(protocol.CodeGameNotActive, "game has not started")
+	errNotYourTurn   = protocol.NewError(protocol.CodeNotYourTurn, "not your turn")
+	errGameOver      = protocol.NewError(protocol.CodeGameOver, "game is already won")
+	errOutOfBounds   = protocol.NewError(protocol.CodeOutOfBounds, "move is outside the board")
+	errCellTaken     = protocol.NewError(protocol.CodeCellTaken, "cell is already taken")
+	errRoomFull      = protocol.NewError(protocol.CodeRoomFull, "room already has two players, join /caro/queue to be matched with another player")
+)
+
+// --- Trạng thái của một ván cờ ---
+// Game lưu trạng thái của một ván cờ (trước đây là các biến toàn cục).
+// Các trường cần được bảo vệ bởi Mutex khi truy cập/thay đổi từ nhiều goroutine.
+type Game struct {
+	rules       config.Caro          // Luật chơi: kích thước bàn cờ (BoardSize) và số quân liên tiếp để thắng (WinCondition)
+	log         *slog.Logger         // Logger gắn sẵn game và room
+	router      *protocol.Router     // Chuyển tin nhắn tới hàm xử lý theo "type"
+	players     map[string]*Player   // Map lưu trữ người chơi, key là Player ID
+	spectators  map[string]*Player   // Người xem: nhận gameState, thông báo và chat, không có quân cờ, không được đi
+	chat        *chat.Room           // Chat của phòng, giữ lịch sử cho người vào sau
+	room        string               // ID phòng, ghi cùng kết quả ván cờ
+	store       storage.Storage      // Nơi lưu kết quả các ván đã kết thúc
+	match       []storage.CaroPlayer // Người chơi và quân cờ của ván đang diễn ra
+	started     time.Time            // Thời điểm ván hiện tại bắt đầu
+	moves       int                  // Số nước đã đi trong ván hiện tại
+	board       [][]string           // Mảng 2 chiều lưu trạng thái bàn cờ
+	currentTurn string               // ID người chơi có lượt đi hiện tại
+	winner      string               // ID người chơi thắng cuộc
+	gameActive  bool                 // Cờ báo hiệu game đang diễn ra hay không
+	mu          sync.Mutex           // Mutex để bảo vệ các trường ở trên (players, board, currentTurn, winner, gameActive)
 }
 
-// --- Biến toàn cục ---
-// Sử dụng map và slice toàn cục để lưu trạng thái game.
-// Cần được bảo vệ bởi Mutex khi truy cập/thay đổi từ nhiều goroutine.
-var (
-	players     = make(map[string]*Player)     // Map lưu trữ người chơi, key là Player ID
-	board       = make([][]string, BOARD_SIZE) // Mảng 2 chiều lưu trạng thái bàn cờ
-	currentTurn string                         // ID người chơi có lượt đi hiện tại
-	winner      string                         // ID người chơi thắng cuộc
-	gameActive  bool                           // Cờ báo hiệu game đang diễn ra hay không
-	mu          sync.Mutex                     // Mutex để bảo vệ các biến toàn cục (players, board, currentTurn, winner, gameActive)
-	upgrader    = websocket.Upgrader{          // Cấu hình để nâng cấp kết nối HTTP lên WebSocket
-		// CheckOrigin kiểm tra nguồn gốc yêu cầu (ở đây cho phép tất cả cho môi trường dev)
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+// Factory: Tạo hàm khởi tạo ván cờ với luật chơi cho trước (có thể bị ghi đè theo từng phòng).
+func Factory(rules config.Caro) game.Factory {
+	return func(env game.Env) (game.Game, error) {
+		// Each room gets its own copy, overrides must not leak to later rooms.
+		rules := rules
+		if err := config.Override(&rules, env.Overrides); err != nil {
+			return nil, err
+		}
+		return New(rules, env), nil
 	}
-)
+}
+
+// New: Tạo một ván cờ mới với bàn cờ trống cho phòng env.Room.
+// Tin nhắn chat đi qua env.Chat, kết quả được lưu vào env.Storage.
+func New(rules config.Caro, env game.Env) *Game {
+	g := &Game{
+		rules:      rules,
+		log:        env.Logger,
+		players:    make(map[string]*Player),
+		spectators: make(map[string]*Player),
+		chat:       env.Chat,
+		room:       env.Room,
+		store:      env.Storage,
+		board:      make([][]string, rules.BoardSize),
+		router:     protocol.NewRouter(),
+	}
+	// Mỗi loại tin nhắn chỉ cần đăng ký một hàm xử lý
+	protocol.Handle(g.router, "move", g.handleMove)
+	protocol.Handle(g.router, "reset", g.handleReset)
+	protocol.Handle(g.router, "chat", g.handleChat)
+	g.initBoard()
+	return g
+}
 
 // initBoard: Khởi tạo (hoặc reset) bàn cờ về trạng thái trống.
 // Cần được gọi bên trong một khu vực đã khóa Mutex hoặc lúc khởi tạo server.
-func initBoard() {
-	log.Println("Initializing board...")
-	for i := 0; i < BOARD_SIZE; i++ {
+func (g *Game) initBoard() {
+	g.log.Debug("initializing board")
+	for i := 0; i < g.rules.BoardSize; i++ {
 		// Tạo các hàng của bàn cờ
-		board[i] = make([]string, BOARD_SIZE)
+		g.board[i] = make([]string, g.rules.BoardSize)
 		// Các ô mặc định là "" (chuỗi rỗng)
 	}
-	currentTurn = ""   // Chưa có ai có lượt
-	winner = ""        // Chưa có người thắng
-	gameActive = false // Game chưa bắt đầu
+	g.currentTurn = ""   // Chưa có ai có lượt
+	g.winner = ""        // Chưa có người thắng
+	g.gameActive = false // Game chưa bắt đầu
 }
 
 // getPlayerList: Lấy danh sách người chơi dưới dạng slice để gửi cho frontend.
 // Chỉ lấy các thông tin cần thiết (ID, Name, Mark), bỏ qua Conn.
 // Cần được gọi bên trong một khu vực đã khóa Mutex.
-func getPlayerList() []Player {
-	playerList := make([]Player, 0, len(players)) // Tạo slice với capacity ban đầu
-	for _, p := range players {
+func (g *Game) getPlayerList() []Player {
+	playerList := make([]Player, 0, len(g.players)) // Tạo slice với capacity ban đầu
+	for _, p := range g.players {
 		// Tạo một bản sao Player chỉ với các trường cần thiết cho JSON
-		playerList = append(playerList, Player{ID: p.ID, Name: p.Name, Mark: p.Mark})
+		playerList = append(playerList, Player{ID: p.ID, Name: p.Name, Mark: p.Mark, Away: p.Away})
 	}
 	return playerList
 }
 
 // assignMarksAndStart: Gán quân cờ (X, O) cho người chơi và bắt đầu game nếu đủ người.
 // Logic đơn giản: người đầu tiên là X, người thứ hai là O.
+// Khi ván đang diễn ra, quân cờ, lượt đi và g.match được giữ nguyên; chỉ người
+// chưa có quân mới nhận quân còn trống (nếu có).
 // Cần được gọi bên trong một khu vực đã khóa Mutex.
-func assignMarksAndStart() {
-	log.Println("Assigning marks and checking start condition...")
+func (g *Game) assignMarksAndStart() {
+	g.log.Debug("assigning marks")
 	// Lấy danh sách con trỏ Player từ map
-	playerList := make([]*Player, 0, len(players))
-	for _, p := range players {
+	playerList := make([]*Player, 0, len(g.players))
+	for _, p := range g.players {
 		playerList = append(playerList, p)
 	}
 
+	if g.gameActive {
+		// Ví dụ người chơi đang được giữ chỗ (Suspend) khi có người mới vào:
+		// không được xáo lại quân cờ của ván đang chơi.
+		g.assignFreeMarks(playerList)
+		return
+	}
+
 	// Reset quân cờ của tất cả người chơi trước khi gán lại
 	for _, p := range playerList {
 		p.Mark = ""
@@ -133,84 +184,116 @@ func assignMarksAndStart() {
 	if len(playerList) >= 1 {
 		playerList[0].Mark = "X"
 		playerX = playerList[0]
-		log.Printf("Assigned Mark 'X' to %s", playerList[0].ID)
+		g.log.Debug("mark assigned", "player_id", playerList[0].ID, "mark", "X")
 	}
 	// Gán O cho người chơi thứ hai (nếu có) và bắt đầu game
 	if len(playerList) >= 2 {
 		playerList[1].Mark = "O"
-		log.Printf("Assigned Mark 'O' to %s", playerList[1].ID)
+		g.log.Debug("mark assigned", "player_id", playerList[1].ID, "mark", "O")
 		if playerX != nil {
-			currentTurn = playerX.ID // Người chơi X đi trước
-			winner = ""              // Đảm bảo chưa có người thắng
-			gameActive = true        // Đánh dấu game đã bắt đầu
-			log.Printf("Game started. Turn: %s (%s)", currentTurn, playerX.Name)
+			gamesStarted.Inc()
+			g.started = time.Now()
+			g.moves = 0
+			// Ghi lại ai cầm quân nào, vì người bỏ dở ván sẽ không còn trong map `players`
+			g.match = []storage.CaroPlayer{
+				{ID: playerList[0].ID, Name: playerList[0].Name, Mark: playerList[0].Mark},
+				{ID: playerList[1].ID, Name: playerList[1].Name, Mark: playerList[1].Mark},
+			}
+			g.currentTurn = playerX.ID // Người chơi X đi trước
+			g.winner = ""              // Đảm bảo chưa có người thắng
+			g.gameActive = true        // Đánh dấu game đã bắt đầu
+			g.log.Info("game started", "turn", g.currentTurn)
 		} else {
 			// Trường hợp này không nên xảy ra nếu logic đúng
-			currentTurn = ""
-			gameActive = false
-			log.Println("Error: Player X not found after assigning marks.")
+			g.currentTurn = ""
+			g.gameActive = false
+			g.log.Error("player X not found after assigning marks")
 		}
 	} else {
 		// Không đủ người chơi
-		currentTurn = ""
-		gameActive = false
-		log.Println("Not enough players to start.")
+		g.currentTurn = ""
+		g.gameActive = false
+		g.log.Debug("not enough players to start")
 	}
 	// Frontend sẽ nhận được thông tin Mark và CurrentTurn qua tin nhắn gameState tiếp theo.
 }
 
+// assignFreeMarks: Gán quân cờ chưa ai cầm cho người chơi chưa có quân, khi ván đang diễn ra.
+// Cần được gọi bên trong một khu vực đã khóa Mutex.
+func (g *Game) assignFreeMarks(playerList []*Player) {
+	held := make(map[string]bool, 2)
+	for _, p := range playerList {
+		if p.Mark != "" {
+			held[p.Mark] = true
+		}
+	}
+	for _, p := range playerList {
+		if p.Mark != "" {
+			continue
+		}
+		for _, mark := range []string{"X", "O"} {
+			if !held[mark] {
+				p.Mark = mark
+				held[mark] = true
+				g.match = append(g.match, storage.CaroPlayer{ID: p.ID, Name: p.Name, Mark: mark})
+				g.log.Debug("mark assigned", "player_id", p.ID, "mark", mark)
+				break
+			}
+		}
+	}
+}
+
 // resetGame: Reset lại toàn bộ trạng thái game.
 // Thường được gọi khi có yêu cầu "reset" từ frontend.
 // Hàm này tự quản lý việc khóa Mutex.
-func resetGame() {
-	mu.Lock()         // Khóa Mutex khi bắt đầu hàm
-	defer mu.Unlock() // Đảm bảo Mutex được mở khóa khi hàm kết thúc
-	log.Println("Resetting game...")
-	initBoard()           // Reset bàn cờ, lượt đi, người thắng
-	assignMarksAndStart() // Gán lại quân cờ và kiểm tra bắt đầu game
-	broadcastGameState()  // Gửi trạng thái mới cho tất cả người chơi
+func (g *Game) resetGame() {
+	g.mu.Lock()         // Khóa Mutex khi bắt đầu hàm
+	defer g.mu.Unlock() // Đảm bảo Mutex được mở khóa khi hàm kết thúc
+	g.log.Info("resetting game")
+	if g.gameActive {
+		gamesFinished.Inc("reset") // Ván đang diễn ra bị bỏ dở
+		g.recordGame("reset")
+	}
+	g.initBoard()           // Reset bàn cờ, lượt đi, người thắng
+	g.assignMarksAndStart() // Gán lại quân cờ và kiểm tra bắt đầu game
+	g.broadcastGameState()  // Gửi trạng thái mới cho tất cả người chơi
 	// Frontend nhận gameState mới và vẽ lại bàn cờ, cập nhật trạng thái.
 }
 
 // broadcastGameState: Gửi trạng thái game hiện tại (GameState) cho tất cả người chơi đang kết nối.
 // Được gọi sau mỗi thay đổi trạng thái quan trọng (nước đi, reset, join, leave).
 // Cần được gọi bên trong một khu vực đã khóa Mutex.
-func broadcastGameState() {
+func (g *Game) broadcastGameState() {
 	// Giả định rằng Mutex đã được khóa bởi hàm gọi nó.
 
-	playerList := getPlayerList() // Lấy danh sách người chơi (đã được đơn giản hóa)
+	playerList := g.getPlayerList() // Lấy danh sách người chơi (đã được đơn giản hóa)
 
 	// Tạo đối tượng GameState
 	gameState := GameState{
-		Type:        "gameState", // Loại tin nhắn để frontend nhận biết
-		Board:       board,       // Trạng thái bàn cờ hiện tại
-		Players:     playerList,  // Danh sách người chơi
-		CurrentTurn: currentTurn, // Lượt đi của ai
-		Winner:      winner,      // Ai thắng (nếu có)
+		Type:        "gameState",   // Loại tin nhắn để frontend nhận biết
+		Board:       g.board,       // Trạng thái bàn cờ hiện tại
+		Players:     playerList,    // Danh sách người chơi
+		CurrentTurn: g.currentTurn, // Lượt đi của ai
+		Winner:      g.winner,      // Ai thắng (nếu có)
 	}
 
 	// Chuyển đổi GameState thành JSON
 	stateJSON, err := json.Marshal(gameState)
 	if err != nil {
-		log.Println("broadcastGameState JSON Marshal error:", err)
+		g.log.Error("marshal game state", "err", err)
 		return // Không gửi nếu có lỗi
 	}
 
-	log.Printf("Broadcasting gameState: Turn=%s, Winner=%s, Players=%d", currentTurn, winner, len(playerList))
+	g.log.Debug("broadcasting game state", "turn", g.currentTurn, "winner", g.winner, "players", len(playerList))
 
 	// Gửi JSON đến từng người chơi trong map `players`
-	for id, player := range players {
-		// Đặt deadline để tránh goroutine bị treo nếu client không phản hồi
-		player.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		// Gửi tin nhắn dạng TextMessage chứa JSON
-		err := player.Conn.WriteMessage(websocket.TextMessage, stateJSON)
-		// Xóa deadline sau khi gửi xong
-		player.Conn.SetWriteDeadline(time.Time{})
-		if err != nil {
-			log.Printf("Failed to send gameState to player %s (%s): %v", id, player.Name, err)
-			// Lưu ý: Không gọi handlePlayerDisconnect trực tiếp ở đây để tránh deadlock.
-			// Lỗi ghi thường sẽ được phát hiện bởi vòng lặp đọc hoặc ping.
-		}
+	// SendState không block: write pump của mỗi kết nối sẽ gửi đi, trạng thái cũ chưa gửi sẽ bị thay thế.
+	// Lỗi ghi sẽ đóng kết nối và được phát hiện bởi vòng lặp đọc trong game.Manager.
+	for _, player := range g.players {
+		player.Conn.SendState(stateJSON)
+	}
+	for _, spectator := range g.spectators {
+		spectator.Conn.SendState(stateJSON)
 	}
 	// Frontend nhận tin nhắn "gameState", parse JSON và cập nhật giao diện:
 	// - Vẽ lại bàn cờ (board)
@@ -221,76 +304,92 @@ func broadcastGameState() {
 
 // notifyPlayerJoinedOrLeave: Thông báo cho tất cả người chơi khi có ai đó vào hoặc rời game.
 // Cần được gọi bên trong một khu vực đã khóa Mutex.
-func notifyPlayerJoinedOrLeave(playerID, playerName, action string) {
+func (g *Game) notifyPlayerJoinedOrLeave(playerID, playerName, action string) {
 	// Giả định rằng Mutex đã được khóa bởi hàm gọi nó.
 
 	// Tạo nội dung thông báo
 	messageText := fmt.Sprintf("%s (%s) %s the game.", playerName, playerID, action) // Ví dụ: "Alice (player123) joined the game."
-	log.Println("Notify:", messageText)
+	g.log.Debug("notify", "message", messageText)
 
 	// Tạo đối tượng thông báo
 	notification := PlayerJoinedOrLeaveMessages{
 		Type:        "playerJoinedOrLeave", // Loại tin nhắn để frontend nhận biết
 		Message:     []string{messageText}, // Mảng chứa các thông báo (ở đây chỉ có 1)
-		TotalPlayer: len(players),          // Số người chơi hiện tại
+		TotalPlayer: len(g.players),        // Số người chơi hiện tại
 	}
 
 	// Chuyển đổi thành JSON
 	messageJSON, err := json.Marshal(notification)
 	if err != nil {
-		log.Println("notifyPlayerJoinedOrLeave JSON Marshal error:", err)
+		g.log.Error("marshal join/leave notification", "err", err)
 		return
 	}
 
 	// Gửi JSON đến tất cả người chơi còn lại
-	for id, player := range players {
+	for id, player := range g.players {
 		// Không gửi thông báo "left" cho chính người vừa rời đi (nếu họ còn trong map tạm thời)
 		if action == "left" && id == playerID {
 			continue
 		}
-		// Đặt deadline và gửi tin nhắn
-		player.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		err := player.Conn.WriteMessage(websocket.TextMessage, messageJSON)
-		player.Conn.SetWriteDeadline(time.Time{})
-		if err != nil {
-			log.Printf("Failed to send notification to player %s (%s): %v", id, player.Name, err)
-		}
+		// Đưa tin nhắn vào hàng đợi gửi của người chơi
+		player.Conn.Send(messageJSON)
+	}
+	for _, spectator := range g.spectators {
+		spectator.Conn.Send(messageJSON)
 	}
 	// Frontend nhận tin nhắn "playerJoinedOrLeave", parse JSON và cập nhật:
 	// - Hiển thị thông báo trong khu vực log/chat (message)
 	// - Cập nhật số lượng người chơi hiển thị (totalPlayer)
 }
 
+// recordGame: Lưu kết quả ván cờ vừa kết thúc ("won", "abandoned" hoặc "reset").
+// Lỗi lưu chỉ được ghi log, ván cờ vẫn tiếp tục bình thường.
+// Cần được gọi bên trong một khu vực đã khóa Mutex.
+func (g *Game) recordGame(result string) {
+	record := storage.CaroGame{
+		Room:     g.room,
+		Players:  g.match,
+		Winner:   g.winner, // Chỉ khác "" khi result là "won"
+		Result:   result,
+		Moves:    g.moves,
+		Started:  g.started,
+		Finished: time.Now(),
+	}
+	if err := g.store.SaveCaroGame(record); err != nil {
+		g.log.Error("save caro game", "result", result, "err", err)
+	}
+}
+
 // switchTurn: Chuyển lượt đi cho người chơi còn lại.
 // Tìm người chơi có Mark ("X" hoặc "O") mà không phải là người có lượt hiện tại.
 // Cần được gọi bên trong một khu vực đã khóa Mutex.
-func switchTurn() {
+func (g *Game) switchTurn() {
 	// Giả định rằng Mutex đã được khóa bởi hàm gọi nó.
 
 	// Không chuyển lượt nếu game chưa active hoặc không đủ 2 người chơi
-	if !gameActive || len(players) < 2 {
-		log.Println("Cannot switch turn: Game not active or not enough players.")
-		currentTurn = ""
+	if !g.gameActive || len(g.players) < 2 {
+		g.log.Debug("cannot switch turn: game not active or not enough players")
+		g.currentTurn = ""
 		return
 	}
 
 	nextTurnPlayerID := ""
 	// Duyệt qua map người chơi để tìm người chơi tiếp theo
-	for _, p := range players {
+	for _, p := range g.players {
 		// Tìm người không phải lượt hiện tại VÀ có quân cờ (là người đang chơi)
-		if p.ID != currentTurn && (p.Mark == "X" || p.Mark == "O") {
+		if p.ID != g.currentTurn && (p.Mark == "X" || p.Mark == "O") {
 			nextTurnPlayerID = p.ID
 			break // Tìm thấy người chơi kia rồi thì dừng
 		}
 	}
 
 	if nextTurnPlayerID != "" {
-		currentTurn = nextTurnPlayerID
-		log.Printf("Switched turn to: %s", currentTurn)
+		g.currentTurn = nextTurnPlayerID
+		g.log.Debug("turn switched", "turn", g.currentTurn)
 	} else {
 		// Trường hợp không tìm thấy người chơi kia (lỗi logic hoặc chỉ còn 1 người?)
-		log.Printf("Could not switch turn. Current: %s. Players: %d. Resetting turn.", currentTurn, len(players))
-		currentTurn = "" // Reset lượt đi để tránh lỗi
+		g.log.Warn("could not switch turn, resetting turn", "turn", g.currentTurn, "players", len(g.players))
+		g.currentTurn = "" // Reset lượt đi để tránh lỗi
 	}
 	// Frontend sẽ nhận được lượt đi mới qua tin nhắn gameState tiếp theo.
 }
@@ -298,8 +397,9 @@ func switchTurn() {
 // checkWin: Kiểm tra xem nước đi cuối cùng tại (x, y) có tạo thành dãy thắng không.
 // Kiểm tra theo 4 hướng: ngang, dọc, chéo chính, chéo phụ.
 // Cần được gọi bên trong một khu vực đã khóa Mutex (vì đọc `board`).
-func checkWin(x, y int, mark string) bool {
+func (g *Game) checkWin(x, y int, mark string) bool {
 	// Giả định rằng Mutex đã được khóa bởi hàm gọi nó.
+	boardSize, winCondition := g.rules.BoardSize, g.rules.WinCondition
 
 	// Mảng chứa các vector hướng kiểm tra: {dx, dy}
 	// {1, 0}: Ngang, {0, 1}: Dọc, {1, 1}: Chéo \, {1, -1}: Chéo /
@@ -308,26 +408,26 @@ func checkWin(x, y int, mark string) bool {
 	for _, dir := range directions {
 		count := 1 // Bắt đầu đếm từ quân cờ vừa đặt (là 1)
 		// Kiểm tra theo hướng dương (ví dụ: sang phải, xuống dưới, ...)
-		for i := 1; i < WIN_CONDITION; i++ {
+		for i := 1; i < winCondition; i++ {
 			nx, ny := x+dir[0]*i, y+dir[1]*i
 			// Kiểm tra nếu ra ngoài bàn cờ hoặc không phải quân cờ của người chơi hiện tại
-			if nx < 0 || nx >= BOARD_SIZE || ny < 0 || ny >= BOARD_SIZE || board[ny][nx] != mark {
+			if nx < 0 || nx >= boardSize || ny < 0 || ny >= boardSize || g.board[ny][nx] != mark {
 				break // Dừng kiểm tra hướng này
 			}
 			count++ // Tăng biến đếm
 		}
 		// Kiểm tra theo hướng âm (ví dụ: sang trái, lên trên, ...)
-		for i := 1; i < WIN_CONDITION; i++ {
+		for i := 1; i < winCondition; i++ {
 			nx, ny := x-dir[0]*i, y-dir[1]*i
 			// Kiểm tra tương tự
-			if nx < 0 || nx >= BOARD_SIZE || ny < 0 || ny >= BOARD_SIZE || board[ny][nx] != mark {
+			if nx < 0 || nx >= boardSize || ny < 0 || ny >= boardSize || g.board[ny][nx] != mark {
 				break
 			}
 			count++
 		}
 		// Nếu đếm đủ số quân liên tiếp theo một hướng nào đó
-		if count >= WIN_CONDITION {
-			log.Printf("Win condition met for %s at (%d, %d) in direction {%d, %d}", mark, x, y, dir[0], dir[1])
+		if count >= winCondition {
+			g.log.Debug("win condition met", "mark", mark, "x", x, "y", y, "dx", dir[0], "dy", dir[1])
 			return true // Người chơi đã thắng
 		}
 	}
@@ -335,192 +435,131 @@ func checkWin(x, y int, mark string) bool {
 }
 
 // handlePlayerDisconnect: Xử lý khi một người chơi ngắt kết nối.
-// Được gọi bởi `defer` trong `HandleConnection` hoặc khi `pingPlayer` thất bại.
+// Được gọi bởi Leave khi vòng lặp đọc trong game.Manager kết thúc.
 // Hàm này tự quản lý việc khóa Mutex.
-func handlePlayerDisconnect(playerID string) {
-	mu.Lock()         // Khóa Mutex khi bắt đầu xử lý
-	defer mu.Unlock() // Đảm bảo Mutex được mở khóa khi kết thúc
+func (g *Game) handlePlayerDisconnect(playerID string) {
+	g.mu.Lock()         // Khóa Mutex khi bắt đầu xử lý
+	defer g.mu.Unlock() // Đảm bảo Mutex được mở khóa khi kết thúc
+
+	// Người xem rời đi không ảnh hưởng tới ván cờ
+	if spectator, watching := g.spectators[playerID]; watching {
+		spectator.Conn.Close()
+		delete(g.spectators, playerID)
+		g.log.Info("spectator left", "player_id", playerID, "spectators", len(g.spectators))
+		return
+	}
 
 	// Kiểm tra xem người chơi có còn trong map không (tránh xử lý trùng lặp)
-	player, exists := players[playerID]
+	player, exists := g.players[playerID]
 	if !exists {
-		// mu.Unlock() // Mở khóa nếu không tìm thấy người chơi
-		log.Printf("Player %s already disconnected or not found.", playerID)
+		// g.mu.Unlock() // Mở khóa nếu không tìm thấy người chơi
+		g.log.Debug("player already disconnected", "player_id", playerID)
 		return
 	}
 
 	playerName := player.Name
-	log.Printf("Handling disconnect for player %s (%s)...", playerID, playerName)
-	player.Conn.Close()       // Đóng kết nối WebSocket
-	delete(players, playerID) // Xóa người chơi khỏi map
-	log.Printf("Player %s (%s) removed. Total players: %d", playerID, playerName, len(players))
+	player.Conn.Close()         // Đóng kết nối WebSocket
+	delete(g.players, playerID) // Xóa người chơi khỏi map
+	g.log.Info("player left", "player_id", playerID, "players", len(g.players))
 
-	wasTurn := currentTurn == playerID // Lưu lại xem có phải lượt của người chơi này không
-	wasActive := gameActive            // Lưu lại xem game có đang diễn ra không
+	wasTurn := g.currentTurn == playerID // Lưu lại xem có phải lượt của người chơi này không
+	wasActive := g.gameActive            // Lưu lại xem game có đang diễn ra không
 
 	// --- Cập nhật trạng thái Game ---
 	if wasActive { // Nếu game đang diễn ra
-		if len(players) < 2 { // Nếu không đủ người chơi nữa
-			log.Println("Game stopped due to insufficient players after disconnect.")
-			gameActive = false // Dừng game
-			currentTurn = ""   // Reset lượt
-			winner = ""        // Reset người thắng
-		} else if wasTurn { // Nếu là lượt của người vừa ngắt kết nối
-			log.Printf("Player %s disconnected on their turn, switching.", playerID)
-			switchTurn() // Chuyển lượt cho người còn lại
+		if len(g.players) < 2 { // Nếu không đủ người chơi nữa
+			g.log.Info("game stopped: not enough players")
+			gamesFinished.Inc("abandoned")
+			g.recordGame("abandoned")
+			g.gameActive = false // Dừng game
+			g.currentTurn = ""   // Reset lượt
+			g.winner = ""        // Reset người thắng
+		} else {
+			// Người đang chờ (nếu có) nhận quân của người vừa rời để ván tiếp tục
+			g.assignMarksAndStart()
+			if wasTurn { // Nếu là lượt của người vừa ngắt kết nối
+				g.log.Debug("player left on their turn, switching", "player_id", playerID)
+				g.switchTurn() // Chuyển lượt cho người còn lại
+			}
 		}
 		// Nếu không phải lượt của họ thì không cần đổi lượt
 	}
 
 	// Gán lại quân cờ nếu game đã dừng hoặc không active, hoặc chỉ còn < 2 người
 	// Điều này đảm bảo người chơi còn lại (nếu có) sẽ là 'X' và sẵn sàng chờ người mới.
-	if !gameActive || len(players) < 2 {
-		log.Println("Re-assigning marks after disconnect.")
-		assignMarksAndStart() // Gán lại X/O và kiểm tra xem có thể bắt đầu lại không
+	if !g.gameActive || len(g.players) < 2 {
+		g.log.Debug("re-assigning marks after disconnect")
+		g.assignMarksAndStart() // Gán lại X/O và kiểm tra xem có thể bắt đầu lại không
 	}
 
 	// --- Thông báo cho những người còn lại ---
 	// Các hàm này cần được gọi khi Mutex đang được giữ
-	broadcastGameState()                                    // Gửi trạng thái game mới nhất
-	notifyPlayerJoinedOrLeave(playerID, playerName, "left") // Thông báo có người rời đi
+	g.broadcastGameState()                                    // Gửi trạng thái game mới nhất
+	g.notifyPlayerJoinedOrLeave(playerID, playerName, "left") // Thông báo có người rời đi
 
 	// Mutex sẽ được mở khóa bởi defer
 	// Frontend nhận gameState và playerJoinedOrLeave, cập nhật giao diện.
 }
 
-// pingPlayer: Gửi tin nhắn Ping đến client định kỳ để giữ kết nối và phát hiện client chết.
-// Chạy trong một goroutine riêng cho mỗi người chơi.
-func pingPlayer(playerID string, conn *websocket.Conn) {
-	// Tạo một ticker gửi tín hiệu sau mỗi 30 giây
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop() // Dừng ticker khi hàm kết thúc
-
-	log.Printf("Ping routine started for %s", playerID)
-
-	// Vòng lặp chạy theo ticker
-	for range ticker.C {
-		// Khóa Mutex ngắn hạn để kiểm tra sự tồn tại và gửi Ping
-		mu.Lock()
-		player, exists := players[playerID]
-		// Kiểm tra xem người chơi có còn trong map không (có thể đã bị disconnect bởi lỗi đọc)
-		if !exists {
-			mu.Unlock()
-			log.Printf("Stopping ping for disconnected player %s", playerID)
-			return // Dừng goroutine ping nếu người chơi không còn
-		}
-
-		// Gửi tin nhắn điều khiển Ping (Control Message)
-		// Đặt deadline cho việc gửi Ping
-		err := player.Conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second))
-		mu.Unlock() // Mở khóa ngay sau khi gửi xong
-
-		if err != nil {
-			// Nếu gửi Ping thất bại -> coi như client đã mất kết nối
-			log.Printf("Ping failed for player %s: %v. Disconnecting.", playerID, err)
-			// Gọi handlePlayerDisconnect để xử lý việc ngắt kết nối
-			// Lưu ý: Gọi handlePlayerDisconnect từ đây có thể gây tranh chấp lock nếu handlePlayerDisconnect đang chạy.
-			// Trong trường hợp phức tạp hơn, có thể cần cơ chế khác (ví dụ: gửi tín hiệu qua channel).
-			// Ở đây, để đơn giản, gọi trực tiếp.
-			handlePlayerDisconnect(playerID)
-			return // Dừng goroutine ping
-		}
-		// log.Printf("Ping sent to %s", playerID) // Ghi log nếu cần debug
-	}
-	log.Printf("Ping routine stopped for %s", playerID)
-}
-
-// HandleConnection: Hàm chính xử lý một kết nối WebSocket mới.
-// Được gọi cho mỗi client kết nối đến endpoint WebSocket.
-func HandleConnection(w http.ResponseWriter, r *http.Request) {
-	// Nâng cấp kết nối HTTP thành WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("Upgrade error:", err)
-		return // Không xử lý nếu nâng cấp thất bại
-	}
-	// Log địa chỉ của client vừa kết nối
-	log.Println("Client connected:", conn.RemoteAddr())
-
-	var playerID string // Biến lưu ID người chơi, sẽ được gán sau khi nhận tin nhắn init
-
-	// --- Defer Cleanup ---
-	// Logic này sẽ được thực thi khi hàm HandleConnection kết thúc (dù là kết thúc bình thường hay do lỗi/panic)
-	defer func() {
-		log.Printf("Defer cleanup executing for connection %s (PlayerID: %s)", conn.RemoteAddr(), playerID)
-		if playerID != "" {
-			// Nếu playerID đã được gán (nghĩa là người chơi đã init thành công)
-			// thì gọi handlePlayerDisconnect để dọn dẹp trạng thái game
-			handlePlayerDisconnect(playerID)
-		} else {
-			// Nếu playerID rỗng (người chơi chưa init hoặc init lỗi)
-			// thì chỉ cần đóng kết nối WebSocket là đủ
-			log.Printf("Closing connection %s (player not fully initialized).", conn.RemoteAddr())
-			conn.Close()
-		}
-	}()
-
-	// --- Cấu hình kết nối WebSocket ---
-	conn.SetReadLimit(512) // Giới hạn kích thước tin nhắn đọc được từ client
-	// Đặt deadline ban đầu cho việc đọc tin nhắn (chờ tin nhắn init)
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	// Thiết lập Pong Handler: khi nhận được tin nhắn Pong từ client (phản hồi Ping từ server),
-	// gia hạn deadline đọc thêm 60 giây.
-	conn.SetPongHandler(func(string) error {
-		// log.Printf("Pong received from %s", playerID) // Ghi log nếu cần debug
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
-	})
-
+// Join: Xử lý tin nhắn "init" của một kết nối mới và thêm người chơi vào ván cờ.
+// Được gọi bởi game.Manager sau khi nâng cấp kết nối lên WebSocket và xác thực session token.
+func (g *Game) Join(conn *game.Conn, session auth.Session, init []byte) error {
 	// --- Khởi tạo người chơi (Player Initialization) ---
-	// Chờ đợi và đọc tin nhắn đầu tiên từ client, mong đợi đó là tin nhắn "init"
-	log.Printf("Waiting for init message from %s...", conn.RemoteAddr())
 	var initMsg InitMessage
-	// Đọc và giải mã JSON từ kết nối vào struct InitMessage
-	err = conn.ReadJSON(&initMsg)
-	if err != nil {
-		// Xử lý lỗi đọc hoặc giải mã JSON
-		// Kiểm tra xem có phải lỗi do client đóng kết nối không
-		if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-			log.Printf("Init read error (client closed connection?) for %s: %v", conn.RemoteAddr(), err)
-		} else {
-			log.Printf("Failed to read/parse init message from %s: %v", conn.RemoteAddr(), err)
-		}
-		// Kết thúc hàm, defer sẽ đóng kết nối
-		return
+	// Giải mã JSON của tin nhắn đầu tiên vào struct InitMessage
+	if err := json.Unmarshal(init, &initMsg); err != nil {
+		g.log.Info("invalid init message", "remote_addr", conn.RemoteAddr().String(), "err", err)
+		return protocol.ErrInvalidInit // game.Manager gửi lỗi (mã INVALID_INIT) cho client
 	}
 	// Log thông tin nhận được từ tin nhắn init
-	log.Printf("Received init message from %s: Type=%s, ID=%s, Name=%s", conn.RemoteAddr(), initMsg.Type, initMsg.Player.ID, initMsg.Player.Name)
+	g.log.Debug("init message received", "remote_addr", conn.RemoteAddr().String(), "type", initMsg.Type, "player_id", session.PlayerID, "name", session.Name)
 
 	// Kiểm tra tính hợp lệ của tin nhắn init
-	if initMsg.Type != "init" || initMsg.Player.ID == "" {
-		log.Printf("Invalid init message type ('%s') or missing ID from %s.", initMsg.Type, conn.RemoteAddr())
-		// Gửi lại tin nhắn lỗi cho client nếu init không hợp lệ
-		conn.WriteJSON(map[string]string{"type": "error", "message": "Invalid initialization message"})
-		// Kết thúc hàm, defer sẽ đóng kết nối
-		return
+	if initMsg.Type != "init" {
+		g.log.Info("invalid init message", "remote_addr", conn.RemoteAddr().String(), "type", initMsg.Type)
+		// Trả lỗi để game.Manager gửi cho client nếu init không hợp lệ
+		return protocol.ErrInvalidInit
 	}
 
-	// Gán playerID và playerName từ tin nhắn init
-	playerID = initMsg.Player.ID
-	playerName := initMsg.Player.Name
+	// Gán playerID và playerName từ session (server quyết định, client không thể giả mạo)
+	playerID := session.PlayerID
+	playerName := session.Name
 	if playerName == "" {
-		// Đặt tên mặc định nếu client không gửi tên
+		// Đặt tên mặc định nếu session không có tên
 		playerName = "Anon_" + playerID[:min(4, len(playerID))] // Lấy 4 ký tự đầu ID làm tên tạm
 	}
 
 	// --- Thêm người chơi vào Game (Locked section) ---
-	mu.Lock() // Khóa Mutex trước khi thay đổi map `players` và trạng thái game
+	g.mu.Lock() // Khóa Mutex trước khi thay đổi map `players` và trạng thái game
+	defer g.mu.Unlock()
 	// Kiểm tra xem ID người chơi này đã tồn tại chưa (tránh kết nối trùng lặp)
-	if _, exists := players[playerID]; exists {
-		log.Printf("Player %s (%s) attempted to connect again while already connected.", playerID, playerName)
-		mu.Unlock() // Mở khóa trước khi gửi tin nhắn lỗi và return
-		// Gửi lỗi cho kết nối *mới* này
-		conn.WriteJSON(map[string]string{"type": "error", "message": "Player ID already connected"})
-		// Quan trọng: Reset playerID về rỗng để defer không gọi handlePlayerDisconnect cho kết nối *mới* này.
-		// Việc disconnect của kết nối *cũ* sẽ do goroutine của kết nối đó xử lý.
-		playerID = ""
-		// Kết thúc hàm cho kết nối *mới*, defer sẽ chỉ đóng conn này.
-		return
+	_, playing := g.players[playerID]
+	_, watching := g.spectators[playerID]
+	if playing || watching {
+		g.log.Warn("player already connected", "player_id", playerID)
+		// Lỗi DUPLICATE_SESSION được gửi cho kết nối *mới* này. Kết nối *cũ* vẫn được giữ nguyên.
+		return protocol.ErrDuplicateSession
+	}
+
+	// Người xem không vào map `players` nên không được gán quân cờ và không tính vào TotalPlayer
+	if conn.Spectator() {
+		g.spectators[playerID] = &Player{ID: playerID, Name: playerName, Conn: conn}
+		g.log.Info("spectator joined", "player_id", playerID, "name", playerName, "spectators", len(g.spectators))
+		conn.SendJSON(PlayerJoinedOrLeaveMessages{
+			Type:        "playerJoinedOrLeave",
+			Message:     []string{"You are watching the game."},
+			TotalPlayer: len(g.players),
+		})
+		g.broadcastGameState() // Người xem nhận bàn cờ hiện tại
+		conn.SendJSON(g.chat.History())
+		return nil
+	}
+
+	// Phòng đã đủ 2 người (kể cả người đang được giữ chỗ): người thứ ba không có
+	// quân cờ nào để chơi, nên được chỉ sang hàng chờ /caro/queue thay vì đứng xem mãi.
+	if len(g.players) >= 2 {
+		g.log.Info("room full, join rejected", "player_id", playerID)
+		return errRoomFull
 	}
 
 	// Tạo đối tượng Player mới
@@ -531,143 +570,244 @@ func HandleConnection(w http.ResponseWriter, r *http.Request) {
 		Mark: "",   // Quân cờ sẽ được gán sau
 	}
 	// Thêm người chơi mới vào map `players`
-	players[playerID] = newPlayer
-	log.Printf("Player %s (%s) added to game. Total players: %d", playerID, playerName, len(players))
+	g.players[playerID] = newPlayer
+	g.log.Info("player joined", "player_id", playerID, "name", playerName, "players", len(g.players))
 
 	// Khởi tạo bàn cờ nếu đây là người chơi đầu tiên (hoặc sau khi reset mà chưa có ai vào lại)
-	if len(players) == 1 && !gameActive {
-		log.Println("First player joined, initializing board.")
-		initBoard()
+	if len(g.players) == 1 && !g.gameActive {
+		g.log.Debug("first player joined, initializing board")
+		g.initBoard()
 	}
 
 	// Gán quân cờ (X/O) và kiểm tra xem game có thể bắt đầu chưa
-	assignMarksAndStart()
+	g.assignMarksAndStart()
 
 	// Gửi trạng thái game và thông báo có người mới vào cho TẤT CẢ người chơi (bao gồm cả người mới)
-	broadcastGameState()
-	notifyPlayerJoinedOrLeave(playerID, playerName, "joined")
-
-	mu.Unlock() // Mở khóa Mutex sau khi hoàn tất cập nhật trạng thái và gửi thông báo ban đầu
-
-	// --- Bắt đầu Goroutine Ping ---
-	// Chạy một goroutine riêng để gửi Ping định kỳ cho client này
-	go pingPlayer(playerID, conn)
-
-	// --- Vòng lặp đọc tin nhắn (Message Read Loop) ---
-	// Vòng lặp vô hạn để liên tục đọc tin nhắn từ client này
-	for {
-		// Gia hạn deadline đọc trước mỗi lần chờ đọc tin nhắn mới
-		// Nếu không nhận được tin nhắn (hoặc Pong) trong 60s, ReadJSON sẽ báo lỗi
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-
-		var rawMsg json.RawMessage    // Đọc tin nhắn dưới dạng byte thô trước
-		err := conn.ReadJSON(&rawMsg) // Đọc và giải mã JSON vào rawMsg
-		if err != nil {
-			// Xử lý lỗi đọc (thường là do client ngắt kết nối hoặc hết deadline)
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Read error (client closed connection?) for player %s (%s): %v", playerID, playerName, err)
-			} else {
-				log.Printf("Read error for player %s (%s): %v", playerID, playerName, err)
-			}
-			// Thoát khỏi vòng lặp đọc, defer sẽ xử lý ngắt kết nối
-			break
-		}
-		// log.Printf("Received raw message from %s", playerID) // Ghi log nếu cần debug
+	g.broadcastGameState()
+	g.notifyPlayerJoinedOrLeave(playerID, playerName, "joined")
+	conn.SendJSON(g.chat.History()) // Người mới nhận các tin nhắn chat trước đó
 
-		// Xác định loại tin nhắn bằng cách giải mã một phần vào GenericMessage
-		var genericMsg GenericMessage
-		if err := json.Unmarshal(rawMsg, &genericMsg); err != nil {
-			log.Printf("Error unmarshalling generic message from %s (%s): %v", playerID, playerName, err)
-			continue // Bỏ qua tin nhắn không hợp lệ và chờ tin nhắn tiếp theo
-		}
-		// log.Printf("Received message type '%s' from %s", genericMsg.Type, playerID) // Ghi log nếu cần debug
-
-		// --- Xử lý tin nhắn (Locked section) ---
-		mu.Lock() // Khóa Mutex trước khi xử lý tin nhắn có thể thay đổi trạng thái game
-		// log.Printf("Acquired lock for message type '%s' from %s", genericMsg.Type, playerID) // Ghi log nếu cần debug
-
-		// Kiểm tra lại xem người chơi có còn tồn tại không
-		// (Có thể đã bị disconnect bởi pingPlayer giữa lúc chờ lock)
-		currentPlayer, exists := players[playerID]
-		if !exists {
-			log.Printf("Player %s (%s) disconnected before message '%s' could be processed.", playerID, playerName, genericMsg.Type)
-			mu.Unlock() // Mở khóa và thoát vòng lặp
-			break
-		}
+	return nil
+}
 
-		// Xử lý dựa trên loại tin nhắn
-		switch genericMsg.Type {
-		case "move": // Nếu là tin nhắn nước đi
-			var msg MoveMessage
-			// Giải mã toàn bộ tin nhắn vào MoveMessage
-			if err := json.Unmarshal(rawMsg, &msg); err != nil {
-				log.Printf("Error unmarshalling move message from %s (%s): %v", playerID, playerName, err)
-				// Thoát switch, unlock sẽ được gọi ở cuối
-				break
-			}
+// Leave: Được gọi bởi game.Manager khi vòng lặp đọc của người chơi kết thúc.
+func (g *Game) Leave(playerID string) {
+	g.handlePlayerDisconnect(playerID)
+}
 
-			// --- Xác thực nước đi ---
-			log.Printf("Validating move (%d, %d) from %s (%s)...", msg.Move.X, msg.Move.Y, playerID, playerName)
-			validMove := true
-			if !gameActive {
-				log.Printf("Move ignored from %s: Game not active.", playerID)
-				validMove = false
-			} else if currentTurn != playerID {
-				log.Printf("Move ignored from %s: Not their turn (Current: %s).", playerID, currentTurn)
-				validMove = false
-			} else if winner != "" {
-				log.Printf("Move ignored from %s: Game already won by %s.", playerID, winner)
-				validMove = false
-			} else if msg.Move.Y < 0 || msg.Move.Y >= BOARD_SIZE || msg.Move.X < 0 || msg.Move.X >= BOARD_SIZE {
-				log.Printf("Move ignored from %s: Out of bounds (%d, %d).", playerID, msg.Move.X, msg.Move.Y)
-				validMove = false
-			} else if board[msg.Move.Y][msg.Move.X] != "" {
-				log.Printf("Move ignored from %s: Cell (%d, %d) already taken by '%s'.", playerID, msg.Move.X, msg.Move.Y, board[msg.Move.Y][msg.Move.X])
-				validMove = false
-			}
+// Suspend: Được gọi bởi game.Manager thay cho Leave khi người chơi mất kết nối.
+// Người chơi giữ nguyên chỗ, quân cờ và lượt đi trong thời gian chờ (conn.resumeGrace);
+// nếu không kết nối lại kịp, Leave sẽ được gọi như bình thường.
+func (g *Game) Suspend(playerID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	player, exists := g.players[playerID]
+	if !exists {
+		return
+	}
+	player.Away = true
+	g.log.Info("player suspended", "player_id", playerID)
+	// Báo cho người còn lại biết đối thủ đang mất kết nối
+	g.broadcastGameState()
+	g.notifyPlayerJoinedOrLeave(playerID, player.Name, "disconnected from")
+}
 
-			// --- Xử lý nước đi hợp lệ ---
-			if validMove {
-				playerMark := currentPlayer.Mark           // Lấy quân cờ của người chơi
-				board[msg.Move.Y][msg.Move.X] = playerMark // Cập nhật bàn cờ
-				log.Printf("Player %s (%s) placed '%s' at (%d, %d)", playerID, currentPlayer.Name, playerMark, msg.Move.X, msg.Move.Y)
-
-				// Kiểm tra thắng thua sau nước đi
-				if checkWin(msg.Move.X, msg.Move.Y, playerMark) {
-					winner = playerID  // Gán người thắng
-					gameActive = false // Dừng game
-					log.Printf("Player %s (%s) won!", playerID, currentPlayer.Name)
-					broadcastGameState() // Gửi trạng thái cuối cùng (có người thắng)
-				} else {
-					// Nếu chưa thắng, chuyển lượt
-					switchTurn()
-					broadcastGameState() // Gửi trạng thái mới (lượt đi mới)
-				}
-				// Frontend nhận gameState, cập nhật bàn cờ, lượt đi, hoặc trạng thái thắng.
-			}
-			// Nếu nước đi không hợp lệ, không làm gì cả, chỉ ghi log.
-
-		case "reset": // Nếu là tin nhắn yêu cầu reset game
-			log.Printf("Player %s (%s) requested reset.", playerID, playerName)
-			// Mở khóa Mutex TRƯỚC KHI gọi resetGame (vì resetGame tự khóa)
-			mu.Unlock()
-			resetGame() // Gọi hàm reset (hàm này sẽ khóa, xử lý, mở khóa, và broadcast)
-			// Quan trọng: Dùng `continue` để nhảy đến lần lặp tiếp theo của vòng `for`,
-			// bỏ qua việc mở khóa `mu.Unlock()` ở cuối vòng lặp này (vì đã mở khóa ở trên).
-			continue
+// Resume: Gắn kết nối mới cho người chơi đang được giữ chỗ và gửi lại toàn bộ trạng thái.
+// Trả về false nếu người chơi không còn trong ván (ví dụ đã bị admin kick).
+func (g *Game) Resume(conn *game.Conn, playerID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	player, exists := g.players[playerID]
+	if !exists {
+		return false
+	}
+	player.Conn = conn
+	player.Away = false
+	g.log.Info("player resumed", "player_id", playerID)
+	// Gửi lại gameState cho tất cả, người vừa kết nối lại nhận được bàn cờ đầy đủ
+	g.broadcastGameState()
+	g.notifyPlayerJoinedOrLeave(playerID, player.Name, "reconnected to")
+	conn.SendJSON(g.chat.History())
+	return true
+}
+
+// Players: Trả về ID của những người chơi đang ở trong ván (dùng cho admin API).
+func (g *Game) Players() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := make([]string, 0, len(g.players))
+	for _, p := range g.getPlayerList() {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// Kick: Admin đuổi một người chơi. Kết nối được đóng với lý do "kicked",
+// sau đó người chơi được xử lý giống như khi tự ngắt kết nối.
+func (g *Game) Kick(playerID string) bool {
+	g.mu.Lock()
+	var conn *game.Conn
+	if player, exists := g.players[playerID]; exists {
+		conn = player.Conn
+	} else if spectator, watching := g.spectators[playerID]; watching {
+		conn = spectator.Conn // Người xem cũng có thể bị kick, ví dụ khi spam chat
+	}
+	if conn != nil {
+		conn.Kick() // Đóng kết nối trước để handlePlayerDisconnect không đóng mà không có lý do
+	}
+	g.mu.Unlock()
+	if conn == nil {
+		return false
+	}
+	g.log.Info("player kicked", "player_id", playerID)
+	g.handlePlayerDisconnect(playerID)
+	return true
+}
+
+// Command: Lệnh admin. Hiện chỉ hỗ trợ "reset" để reset ván cờ bị kẹt.
+func (g *Game) Command(name string) error {
+	switch name {
+	case "reset":
+		g.resetGame()
+		return nil
+	default:
+		return game.ErrUnknownCommand
+	}
+}
+
+// HandleMessage: Xử lý một tin nhắn đọc được từ người chơi.
+// Router giải mã tin nhắn theo "type" rồi gọi hàm xử lý đã đăng ký trong New.
+func (g *Game) HandleMessage(playerID string, rawMsg []byte) error {
+	g.mu.Lock()
+	_, watching := g.spectators[playerID]
+	g.mu.Unlock()
+	if msgType, _ := protocol.TypeOf(rawMsg); watching && msgType != "chat" {
+		return protocol.ErrSpectator // Người xem chỉ được chat, không được đi hoặc reset ván cờ
+	}
+	return g.router.Dispatch(playerID, rawMsg)
+}
+
+// handleChat: Xử lý tin nhắn "chat" của người chơi hoặc người xem.
+// Tin nhắn qua bộ lọc của phòng (mute, độ dài, từ cấm) rồi được gửi cho tất cả.
+func (g *Game) handleChat(playerID string, msg chat.SendMessage) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	sender, exists := g.players[playerID]
+	if !exists {
+		sender, exists = g.spectators[playerID]
+	}
+	if !exists {
+		return nil // Đã rời phòng trong lúc chờ lock
+	}
+	posted, err := g.chat.Post(playerID, sender.Name, msg.Text)
+	if err != nil {
+		return err // Lỗi CHAT_REJECTED hoặc MUTED chỉ gửi cho người gửi
+	}
+	messageJSON, err := json.Marshal(posted)
+	if err != nil {
+		return err
+	}
+	for _, player := range g.players {
+		player.Conn.Send(messageJSON)
+	}
+	for _, spectator := range g.spectators {
+		spectator.Conn.Send(messageJSON)
+	}
+	return nil
+}
+
+// handleReset: Xử lý tin nhắn "reset".
+// Được xử lý ngoài khu vực khóa vì resetGame tự khóa Mutex.
+func (g *Game) handleReset(playerID string, _ protocol.Envelope) error {
+	g.log.Info("reset requested", "player_id", playerID)
+	g.resetGame() // Gọi hàm reset (hàm này sẽ khóa, xử lý, mở khóa, và broadcast)
+	return nil
+}
+
+// handleMove: Xử lý tin nhắn "move" (nước đi).
+func (g *Game) handleMove(playerID string, msg MoveMessage) error {
+	// --- Xử lý tin nhắn (Locked section) ---
+	g.mu.Lock() // Khóa Mutex trước khi xử lý tin nhắn có thể thay đổi trạng thái game
+	defer g.mu.Unlock()
+
+	// Kiểm tra lại xem người chơi có còn tồn tại không
+	// (Có thể đã bị disconnect giữa lúc chờ lock)
+	currentPlayer, exists := g.players[playerID]
+	if !exists {
+		g.log.Debug("player left before message was processed", "player_id", playerID, "type", msg.Type)
+		return nil
+	}
+
+	// --- Xác thực nước đi ---
+	var moveErr error // Lý do từ chối nước đi, được gửi cho client kèm mã lỗi
+	// Ván đã thắng cũng không còn active, nên phải kiểm tra winner trước.
+	if g.winner != "" {
+		g.log.Debug("move ignored: game already won", "player_id", playerID, "winner", g.winner)
+		moveErr = errGameOver
+	} else if !g.gameActive {
+		g.log.Debug("move ignored: game not active", "player_id", playerID)
+		moveErr = errGameNotActive
+	} else if g.currentTurn != playerID {
+		g.log.Debug("move ignored: not their turn", "player_id", playerID, "turn", g.currentTurn)
+		moveErr = errNotYourTurn
+	} else if msg.Move.Y < 0 || msg.Move.Y >= g.rules.BoardSize || msg.Move.X < 0 || msg.Move.X >= g.rules.BoardSize {
+		g.log.Debug("move ignored: out of bounds", "player_id", playerID, "x", msg.Move.X, "y", msg.Move.Y)
+		moveErr = errOutOfBounds
+	} else if g.board[msg.Move.Y][msg.Move.X] != "" {
+		g.log.Debug("move ignored: cell taken", "player_id", playerID, "x", msg.Move.X, "y", msg.Move.Y, "mark", g.board[msg.Move.Y][msg.Move.X])
+		moveErr = errCellTaken
+	}
 
-		default: // Loại tin nhắn không xác định
-			log.Printf("Received unknown message type '%s' from %s (%s)", genericMsg.Type, playerID, playerName)
+	// --- Xử lý nước đi hợp lệ ---
+	if moveErr == nil {
+		playerMark := currentPlayer.Mark             // Lấy quân cờ của người chơi
+		g.board[msg.Move.Y][msg.Move.X] = playerMark // Cập nhật bàn cờ
+		g.moves++
+		g.log.Debug("move placed", "player_id", playerID, "mark", playerMark, "x", msg.Move.X, "y", msg.Move.Y)
+
+		// Kiểm tra thắng thua sau nước đi
+		if g.checkWin(msg.Move.X, msg.Move.Y, playerMark) {
+			g.winner = playerID  // Gán người thắng
+			g.gameActive = false // Dừng game
+			g.log.Info("game won", "player_id", playerID)
+			gamesFinished.Inc("won")
+			g.recordGame("won")
+			g.broadcastGameState() // Gửi trạng thái cuối cùng (có người thắng)
+		} else {
+			// Nếu chưa thắng, chuyển lượt
+			g.switchTurn()
+			g.broadcastGameState() // Gửi trạng thái mới (lượt đi mới)
 		}
+		// Frontend nhận gameState, cập nhật bàn cờ, lượt đi, hoặc trạng thái thắng.
+	}
+	// Nếu nước đi không hợp lệ, bàn cờ giữ nguyên và client nhận lỗi với mã tương ứng.
+	return moveErr
+}
+
+// Snapshot: Trả về bản sao trạng thái hiện tại của ván cờ.
+func (g *Game) Snapshot() any {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-		// log.Printf("Releasing lock for message type '%s' from %s", genericMsg.Type, playerID) // Ghi log nếu cần debug
-		mu.Unlock() // Mở khóa Mutex sau khi xử lý xong một tin nhắn (trừ trường hợp 'reset')
+	board := make([][]string, len(g.board))
+	for i, row := range g.board {
+		board[i] = append([]string(nil), row...)
+	}
+	return GameState{
+		Type:        "gameState",
+		Board:       board,
+		Players:     g.getPlayerList(),
+		CurrentTurn: g.currentTurn,
+		Winner:      g.winner,
 	}
-	// Kết thúc vòng lặp đọc (do lỗi hoặc client đóng kết nối)
-	log.Printf("Message read loop stopped for %s (%s)", playerID, playerName)
-	// defer sẽ được thực thi để dọn dẹp
 }
 
+// Caro không cần vòng lặp game, mọi thay đổi đều đến từ tin nhắn của người chơi.
+func (g *Game) TickInterval() time.Duration { return 0 }
+
+func (g *Game) Tick() {}
+
 // Helper function (not strictly necessary but good practice)
 func min(a, b int) int {
 	if a < b {
@@ -675,6 +815,3 @@ func min(a, b int) int {
 	}
 	return b
 }
-
-// GameLoop is not used in this WebSocket model
-// func GameLoop() { ... }
@@ -0,0 +1,61 @@
+package caro
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/simplegameserver/gameserver/chat"
+	"github.com/simplegameserver/gameserver/config"
+	"github.com/simplegameserver/gameserver/game"
+	"github.com/simplegameserver/gameserver/storage"
+)
+
+func env(overrides map[string]string) game.Env {
+	return game.Env{
+		Room:      "test",
+		Logger:    slog.Default(),
+		Overrides: overrides,
+		Chat:      chat.NewRoom(10, chat.Chain()),
+		Storage:   storage.NewMemory(100),
+	}
+}
+
+func TestFactoryOverridesOneRoom(t *testing.T) {
+	newGame := Factory(config.Default().Caro)
+	custom, err := newGame(env(map[string]string{"boardSize": "7"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := custom.(*Game).rules.BoardSize; size != 7 {
+		t.Errorf("overridden room: boardSize = %d, want 7", size)
+	}
+	if _, err := newGame(env(map[string]string{"boardSize": "2"})); err == nil {
+		t.Error("boardSize 2 was accepted")
+	}
+
+	def, err := newGame(env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := def.(*Game).rules; rules != config.Default().Caro {
+		t.Errorf("default room after overridden ones: rules = %+v, want %+v", rules, config.Default().Caro)
+	}
+}
+
+func TestMoveAfterWin(t *testing.T) {
+	g, err := Factory(config.Default().Caro)(env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := g.(*Game)
+	c.players["a"] = &Player{ID: "a", Mark: "X"}
+	c.players["b"] = &Player{ID: "b", Mark: "O"}
+	// a vừa thắng, ván kết thúc.
+	c.winner, c.currentTurn, c.gameActive = "a", "b", false
+
+	for _, id := range []string{"a", "b"} {
+		if err := c.handleMove(id, MoveMessage{Type: "move", Move: Move{X: 1, Y: 1}}); err != errGameOver {
+			t.Errorf("move of %s after the win: err = %v, want %v", id, err, errGameOver)
+		}
+	}
+}
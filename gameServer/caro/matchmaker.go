@@ -0,0 +1,195 @@
+package caro
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/simplegameserver/gameserver/game"
+	"github.com/simplegameserver/gameserver/protocol"
+)
+
+// QueuePositionMessage: Gửi cho người chơi đang chờ mỗi khi vị trí của họ trong hàng đợi thay đổi.
+type QueuePositionMessage struct {
+	Type     string `json:"type"`     // Luôn là "queuePosition"
+	Position int    `json:"position"` // Vị trí trong hàng đợi, bắt đầu từ 1
+	Waiting  int    `json:"waiting"`  // Tổng số người đang chờ
+}
+
+// MatchFoundMessage: Gửi cho hai người chơi vừa được ghép cặp.
+// Frontend kết nối lại tới /caro?room=<RoomID> để bắt đầu chơi.
+type MatchFoundMessage struct {
+	Type     string `json:"type"`     // Luôn là "matchFound"
+	RoomID   string `json:"roomId"`   // ID phòng vừa được tạo cho trận đấu
+	Opponent Player `json:"opponent"` // Đối thủ (chỉ gồm ID, Name)
+}
+
+// queueEntry: Một người chơi đang chờ trong hàng đợi.
+type queueEntry struct {
+	player Player
+	conn   *game.Conn
+}
+
+// Matchmaker: Hàng đợi ghép cặp người chơi vào các phòng caro mới.
+// Mỗi khi có đủ 2 người chờ, một phòng mới được tạo qua rooms.Create().
+type Matchmaker struct {
+	rooms *game.Manager
+	log   *slog.Logger
+
+	mu      sync.Mutex    // Bảo vệ queue và closing
+	queue   []*queueEntry // Người chơi đang chờ, theo thứ tự vào hàng
+	closing bool          // Server đang tắt, không nhận thêm người chờ
+}
+
+func NewMatchmaker(rooms *game.Manager) *Matchmaker {
+	return &Matchmaker{rooms: rooms, log: slog.With("game", rooms.Name(), "component", "matchmaker")}
+}
+
+// ServeHTTP: Xác thực session token, nhận kết nối WebSocket, đọc tin nhắn "init" rồi đưa người chơi vào hàng đợi.
+// Kết nối được giữ cho tới khi ghép cặp xong hoặc người chơi rời đi.
+func (mm *Matchmaker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, ok := mm.rooms.Authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	ws, err := mm.rooms.Upgrade(w, r)
+	if err != nil {
+		mm.log.Warn("websocket upgrade failed", "remote_addr", r.RemoteAddr, "err", err)
+		return
+	}
+
+	conn := mm.rooms.NewConn(ws) // Mọi tin nhắn gửi đi đều qua write pump của kết nối
+
+	ws.SetReadDeadline(time.Now().Add(mm.rooms.HandshakeTimeout()))
+	_, init, err := ws.ReadMessage()
+	if err != nil {
+		mm.log.Info("failed to read init message", "remote_addr", ws.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	// Kiểm tra phiên bản giao thức, trả initAck hoặc lỗi yêu cầu cập nhật client
+	if !conn.Handshake(init, nil, session.PlayerID) {
+		return
+	}
+	// Người xem vào thẳng phòng (/caro?room=...), hàng đợi chỉ dành cho người chơi
+	if conn.Spectator() {
+		conn.SendJSON(protocol.ErrorFrame(protocol.ErrSpectator))
+		conn.CloseWithReason(websocket.ClosePolicyViolation, "spectators cannot queue")
+		return
+	}
+	// Người chơi có thể chờ lâu, không giới hạn thời gian đọc nữa
+	ws.SetReadDeadline(time.Time{})
+
+	entry := &queueEntry{
+		player: Player{ID: session.PlayerID, Name: session.Name},
+		conn:   conn,
+	}
+	mm.enqueue(entry)
+
+	// Chỉ đọc để phát hiện người chơi ngắt kết nối; mọi tin nhắn khác bị bỏ qua.
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			break
+		}
+	}
+	mm.remove(entry)
+}
+
+// Shutdown: Đóng kết nối của mọi người đang chờ với lý do "server shutting down".
+func (mm *Matchmaker) Shutdown() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	mm.closing = true
+	for _, e := range mm.queue {
+		e.conn.CloseWithReason(websocket.CloseServiceRestart, "server shutting down")
+	}
+	mm.queue = nil
+}
+
+func (mm *Matchmaker) enqueue(entry *queueEntry) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	if mm.closing {
+		entry.conn.CloseWithReason(websocket.CloseServiceRestart, "server shutting down")
+		return
+	}
+
+	// Cùng một session ở hai tab: kết nối mới thay kết nối cũ và giữ vị trí của nó,
+	// thay vì ghép người chơi với chính họ
+	for i, e := range mm.queue {
+		if e.player.ID == entry.player.ID {
+			e.conn.Disconnect("replaced")
+			mm.queue[i] = entry
+			mm.log.Info("queued connection replaced", "player_id", entry.player.ID)
+			mm.sendPositions()
+			return
+		}
+	}
+	mm.queue = append(mm.queue, entry)
+	mm.log.Info("player queued", "player_id", entry.player.ID, "waiting", len(mm.queue))
+
+	for len(mm.queue) >= 2 {
+		first, second := mm.queue[0], mm.queue[1]
+		mm.queue = mm.queue[2:]
+		mm.startMatch(first, second)
+	}
+	mm.sendPositions()
+}
+
+// remove: Xóa người chơi khỏi hàng đợi (không làm gì nếu họ đã được ghép cặp).
+func (mm *Matchmaker) remove(entry *queueEntry) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	entry.conn.Close()
+	for i, e := range mm.queue {
+		if e == entry {
+			mm.queue = append(mm.queue[:i], mm.queue[i+1:]...)
+			mm.log.Info("player left queue", "player_id", entry.player.ID, "waiting", len(mm.queue))
+			mm.sendPositions()
+			return
+		}
+	}
+}
+
+// startMatch: Tạo phòng mới cho hai người chơi và báo cho cả hai.
+// Cần được gọi bên trong một khu vực đã khóa Mutex.
+func (mm *Matchmaker) startMatch(a, b *queueEntry) {
+	// Chỉ hai người được ghép cặp mới được vào phòng với vai trò người chơi
+	room, err := mm.rooms.Create(nil, a.player.ID, b.player.ID)
+	if err != nil {
+		// Chỉ xảy ra khi server đang tắt
+		mm.log.Error("could not create room", "player_id", a.player.ID, "opponent_id", b.player.ID, "err", err)
+		a.conn.CloseWithReason(websocket.CloseServiceRestart, err.Error())
+		b.conn.CloseWithReason(websocket.CloseServiceRestart, err.Error())
+		return
+	}
+	mm.log.Info("match found", "room", room.ID, "player_id", a.player.ID, "opponent_id", b.player.ID)
+
+	mm.send(a, MatchFoundMessage{Type: "matchFound", RoomID: room.ID, Opponent: b.player})
+	mm.send(b, MatchFoundMessage{Type: "matchFound", RoomID: room.ID, Opponent: a.player})
+
+	// Đóng kết nối hàng đợi sau khi gửi xong matchFound; frontend sẽ kết nối tới phòng mới.
+	a.conn.CloseWithReason(websocket.CloseNormalClosure, "match found")
+	b.conn.CloseWithReason(websocket.CloseNormalClosure, "match found")
+}
+
+// sendPositions: Gửi vị trí hiện tại cho mọi người đang chờ.
+// Cần được gọi bên trong một khu vực đã khóa Mutex.
+func (mm *Matchmaker) sendPositions() {
+	for i, e := range mm.queue {
+		mm.send(e, QueuePositionMessage{Type: "queuePosition", Position: i + 1, Waiting: len(mm.queue)})
+	}
+}
+
+func (mm *Matchmaker) send(e *queueEntry, msg any) {
+	if err := e.conn.SendJSON(msg); err != nil {
+		mm.log.Error("marshal queue message", "player_id", e.player.ID, "err", err)
+	}
+}
@@ -0,0 +1,10 @@
+package caro
+
+import "github.com/simplegameserver/gameserver/metrics"
+
+var (
+	gamesStarted = metrics.NewCounter("gameserver_caro_games_started_total",
+		"Caro games started.")
+	gamesFinished = metrics.NewCounter("gameserver_caro_games_finished_total",
+		"Caro games finished, by result (won, abandoned, reset).", "result")
+)
@@ -0,0 +1,103 @@
+// Package chat holds the text chat of a room: the messages players send,
+// the bounded history new joiners receive and the filters every message
+// passes through. Games broadcast the messages themselves, next to their
+// join/leave notifications.
+package chat
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simplegameserver/gameserver/config"
+	"github.com/simplegameserver/gameserver/protocol"
+)
+
+var (
+	ErrEmpty = protocol.NewError(protocol.CodeChatRejected, "chat message is empty")
+	ErrMuted = protocol.NewError(protocol.CodeMuted, "you are muted")
+)
+
+// SendMessage is sent by clients to chat.
+type SendMessage struct {
+	Type string `json:"type"` // Always "chat"
+	Text string `json:"text"`
+}
+
+// Message is one chat line as broadcast to the room.
+type Message struct {
+	Type     string `json:"type"` // Always "chat"
+	PlayerID string `json:"playerId"`
+	Name     string `json:"name"`
+	Text     string `json:"text"`
+	Time     int64  `json:"time"` // Unix milliseconds
+}
+
+// History is sent to clients when they join, oldest message first.
+type History struct {
+	Type     string    `json:"type"` // Always "chatHistory"
+	Messages []Message `json:"messages"`
+}
+
+// Room is the chat of one game room. Its methods may be called from any
+// goroutine.
+type Room struct {
+	filter Filter
+	size   int
+
+	mu      sync.Mutex
+	history []Message
+}
+
+// NewRoom creates the chat of a room keeping the last historySize
+// messages. Every message passes through filter, which may be nil.
+func NewRoom(historySize int, filter Filter) *Room {
+	return &Room{filter: filter, size: historySize}
+}
+
+// DefaultFilter returns the filters configured by cfg: mutes, then the
+// length limit, then banned words.
+func DefaultFilter(cfg config.Chat, mutes *Mutes) Filter {
+	return Chain(mutes, MaxLength(cfg.MaxLength), BannedWords(cfg.BannedWords))
+}
+
+// Post filters a message from a player and adds it to the history. The
+// returned message is the one to broadcast; an error is sent back to the
+// player instead.
+func (r *Room) Post(playerID, name, text string) (Message, error) {
+	msg := Message{
+		Type:     "chat",
+		PlayerID: playerID,
+		Name:     name,
+		Text:     strings.TrimSpace(text),
+		Time:     time.Now().UnixMilli(),
+	}
+	if msg.Text == "" {
+		rejected.Inc()
+		return Message{}, ErrEmpty
+	}
+	if r.filter != nil {
+		if err := r.filter.Filter(&msg); err != nil {
+			rejected.Inc()
+			return Message{}, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 {
+		if len(r.history) == r.size {
+			r.history = append(r.history[:0], r.history[1:]...)
+		}
+		r.history = append(r.history, msg)
+	}
+	messagesPosted.Inc()
+	return msg, nil
+}
+
+// History returns the messages kept so far.
+func (r *Room) History() History {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return History{Type: "chatHistory", Messages: append([]Message{}, r.history...)}
+}
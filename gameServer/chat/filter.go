@@ -0,0 +1,112 @@
+package chat
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/simplegameserver/gameserver/protocol"
+)
+
+// Filter checks a chat message before it is broadcast. It may rewrite
+// msg.Text; a returned error rejects the message and is sent to the
+// player, so it should be a *protocol.Error.
+type Filter interface {
+	Filter(msg *Message) error
+}
+
+// FilterFunc adapts a function to Filter.
+type FilterFunc func(msg *Message) error
+
+func (f FilterFunc) Filter(msg *Message) error { return f(msg) }
+
+// Chain runs filters in order and stops at the first error. Nil filters
+// are skipped.
+func Chain(filters ...Filter) Filter {
+	return FilterFunc(func(msg *Message) error {
+		for _, f := range filters {
+			if f == nil {
+				continue
+			}
+			if err := f.Filter(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MaxLength rejects messages longer than n characters.
+func MaxLength(n int) Filter {
+	err := protocol.NewError(protocol.CodeChatRejected, fmt.Sprintf("chat messages are limited to %d characters", n))
+	return FilterFunc(func(msg *Message) error {
+		if utf8.RuneCountInString(msg.Text) > n {
+			return err
+		}
+		return nil
+	})
+}
+
+// BannedWords masks the given words, ignoring case, with asterisks.
+func BannedWords(words []string) Filter {
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	banned := regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	return FilterFunc(func(msg *Message) error {
+		msg.Text = banned.ReplaceAllStringFunc(msg.Text, func(w string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(w))
+		})
+		return nil
+	})
+}
+
+// Mutes keeps the players muted in a room. It is a Filter rejecting their
+// messages with ErrMuted.
+type Mutes struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func NewMutes() *Mutes {
+	return &Mutes{until: make(map[string]time.Time)}
+}
+
+// Mute silences playerID for d.
+func (m *Mutes) Mute(playerID string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.until[playerID] = time.Now().Add(d)
+}
+
+// Unmute lifts the mute of playerID and reports whether they were muted.
+func (m *Mutes) Unmute(playerID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	until, ok := m.until[playerID]
+	delete(m.until, playerID)
+	return ok && time.Now().Before(until)
+}
+
+func (m *Mutes) Filter(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	until, ok := m.until[msg.PlayerID]
+	if !ok {
+		return nil
+	}
+	if time.Now().Before(until) {
+		return ErrMuted
+	}
+	delete(m.until, msg.PlayerID)
+	return nil
+}
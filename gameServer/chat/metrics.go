@@ -0,0 +1,10 @@
+package chat
+
+import "github.com/simplegameserver/gameserver/metrics"
+
+var (
+	messagesPosted = metrics.NewCounter("gameserver_chat_messages_total",
+		"Chat messages broadcast to a room.")
+	rejected = metrics.NewCounter("gameserver_chat_rejected_total",
+		"Chat messages rejected as empty, too long or from a muted player.")
+)
@@ -0,0 +1,448 @@
+// Package config holds the server settings and game rules. Values are
+// loaded from defaults, an optional JSON file, GAMESERVER_* environment
+// variables and command-line flags, in that order, and validated.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+type Config struct {
+	Server      Server      `json:"server"`
+	Log         Log         `json:"log"`
+	Health      Health      `json:"health"`
+	Admin       Admin       `json:"admin"`
+	Auth        Auth        `json:"auth"`
+	Storage     Storage     `json:"storage"`
+	Handshake   Handshake   `json:"handshake"`
+	Conn        Conn        `json:"conn"`
+	RateLimit   RateLimit   `json:"rateLimit"`
+	Chat        Chat        `json:"chat"`
+	Snake       Snake       `json:"snake"`
+	Leaderboard Leaderboard `json:"leaderboard"`
+	Caro        Caro        `json:"caro"`
+	Graph       Graph       `json:"graph"`
+}
+
+type Server struct {
+	Addr            string        `json:"addr"`
+	ShutdownTimeout time.Duration `json:"shutdownTimeout"`
+}
+
+// Log selects the minimum level ("debug", "info", "warn", "error") and the
+// output format ("text" or "json") of the server logs.
+type Log struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// Health configures /readyz. A game loop that has not completed a tick for
+// StallIntervals tick intervals is reported as stalled.
+type Health struct {
+	StallIntervals int `json:"stallIntervals"`
+}
+
+// Admin configures the /admin API. It is disabled while Token is empty;
+// requests must send it as "Authorization: Bearer <token>".
+type Admin struct {
+	Token string `json:"token"`
+}
+
+// Auth configures the session tokens issued by /login. With an empty
+// Secret a random one is generated at startup. Each login saves a player
+// profile, so one IP may only log in LoginsPerMinute times a minute.
+type Auth struct {
+	Secret          string        `json:"secret"`
+	TokenTTL        time.Duration `json:"tokenTTL"`
+	LoginsPerMinute int           `json:"loginsPerMinute"`
+}
+
+// Storage configures where player profiles and game results are kept.
+// Path is an append-only log replayed at startup; while it is empty they
+// are only kept in memory. History is how many results of each kind are
+// kept in memory per player, older ones stay in the log. QueueSize caps
+// the records waiting to be written to the log.
+type Storage struct {
+	Path      string `json:"path"`
+	History   int    `json:"history"`
+	QueueSize int    `json:"queueSize"`
+}
+
+// Handshake configures who may open a websocket. AllowedOrigins lists the
+// browser origins accepted, "*" accepts any; requests without an Origin
+// header (non-browser clients) are always accepted. MaxConns and
+// MaxConnsPerIP cap the open websockets of the whole server. Timeout
+// bounds the upgrade and the wait for the init message.
+type Handshake struct {
+	AllowedOrigins []string      `json:"allowedOrigins"`
+	MaxConns       int           `json:"maxConns"`
+	MaxConnsPerIP  int           `json:"maxConnsPerIP"`
+	Timeout        time.Duration `json:"timeout"`
+}
+
+// Conn configures every websocket connection.
+type Conn struct {
+	PingInterval  time.Duration `json:"pingInterval"`
+	ReadTimeout   time.Duration `json:"readTimeout"`
+	WriteTimeout  time.Duration `json:"writeTimeout"`
+	ReadLimit     int64         `json:"readLimit"`
+	SendQueueSize int           `json:"sendQueueSize"`
+	// Compression enables permessage-deflate for clients that offer it.
+	// Messages shorter than CompressionThreshold bytes are sent
+	// uncompressed, the rest at CompressionLevel (-2 to 9, see
+	// compress/flate).
+	Compression          bool `json:"compression"`
+	CompressionLevel     int  `json:"compressionLevel"`
+	CompressionThreshold int  `json:"compressionThreshold"`
+	// ResumeGrace is how long the games that support it hold the place of
+	// a player whose connection was lost. Zero disables resuming.
+	ResumeGrace time.Duration `json:"resumeGrace"`
+}
+
+// RateLimit throttles the messages of each connection with a token bucket
+// per message type refilled at Rate per second up to Burst. Messages over
+// the limit are warned about, then dropped after DropAfter violations, and
+// the client is disconnected after DisconnectAfter. Violations are
+// forgotten after Cooldown without any. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate            float64       `json:"rate"`
+	Burst           int           `json:"burst"`
+	DropAfter       int           `json:"dropAfter"`
+	DisconnectAfter int           `json:"disconnectAfter"`
+	Cooldown        time.Duration `json:"cooldown"`
+	// MaxInvalidDirections is how many invalid or malformed direction
+	// messages a snake player may send before being disconnected. It
+	// applies even when Rate is zero.
+	MaxInvalidDirections int `json:"maxInvalidDirections"`
+}
+
+// Chat configures the in-room chat. Each room keeps its last History
+// messages for new joiners; messages longer than MaxLength characters are
+// rejected and BannedWords are masked.
+type Chat struct {
+	MaxLength   int      `json:"maxLength"`
+	History     int      `json:"history"`
+	BannedWords []string `json:"bannedWords"`
+}
+
+// Leaderboard configures the snake high-score tables. Each board keeps
+// the best Size players.
+type Leaderboard struct {
+	Size int `json:"size"`
+}
+
+// Snake holds the snake rules. Those tagged override:"room" can be
+// overridden per room.
+type Snake struct {
+	NumCells     int           `json:"numCells" override:"room"`
+	InitSize     int           `json:"initSize" override:"room"`
+	Foods        int           `json:"foods" override:"room"`
+	TickInterval time.Duration `json:"tickInterval" override:"room"`
+	// KeyframeInterval is how many ticks apart full states are sent to
+	// clients receiving delta updates.
+	KeyframeInterval int `json:"keyframeInterval"`
+}
+
+// Caro holds the caro rules. They can be overridden per room.
+type Caro struct {
+	BoardSize    int `json:"boardSize" override:"room"`
+	WinCondition int `json:"winCondition" override:"room"`
+}
+
+// Graph holds the graph rules. They can be overridden per room.
+type Graph struct {
+	HitDistance float64 `json:"hitDistance" override:"room"`
+}
+
+// Default returns the values the server used before they were configurable.
+func Default() Config {
+	return Config{
+		Server: Server{
+			Addr:            ":8080",
+			ShutdownTimeout: 10 * time.Second,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		Health: Health{
+			StallIntervals: 10,
+		},
+		Auth: Auth{
+			TokenTTL:        24 * time.Hour,
+			LoginsPerMinute: 10,
+		},
+		Handshake: Handshake{
+			AllowedOrigins: []string{"http://localhost:5173"},
+			MaxConns:       10000,
+			MaxConnsPerIP:  20,
+			Timeout:        10 * time.Second,
+		},
+		Conn: Conn{
+			PingInterval:  30 * time.Second,
+			ReadTimeout:   60 * time.Second,
+			WriteTimeout:  10 * time.Second,
+			ReadLimit:     1024,
+			SendQueueSize: 64,
+
+			Compression:          true,
+			CompressionLevel:     1,
+			CompressionThreshold: 256,
+			ResumeGrace:          30 * time.Second,
+		},
+		RateLimit: RateLimit{
+			Rate:            20,
+			Burst:           40,
+			DropAfter:       5,
+			DisconnectAfter: 100,
+			Cooldown:        10 * time.Second,
+
+			MaxInvalidDirections: 5,
+		},
+		Chat: Chat{
+			MaxLength: 200,
+			History:   50,
+		},
+		Storage: Storage{
+			History:   100,
+			QueueSize: 10000,
+		},
+		Snake: Snake{
+			NumCells:     30,
+			InitSize:     3,
+			Foods:        5,
+			TickInterval: 100 * time.Millisecond,
+
+			KeyframeInterval: 50,
+		},
+		Leaderboard: Leaderboard{
+			Size: 10,
+		},
+		Caro: Caro{
+			BoardSize:    15,
+			WinCondition: 5,
+		},
+		Graph: Graph{
+			HitDistance: 0.5,
+		},
+	}
+}
+
+func (c Config) Validate() error {
+	return errors.Join(
+		c.Server.Validate(),
+		c.Log.Validate(),
+		c.Health.Validate(),
+		c.Admin.Validate(),
+		c.Auth.Validate(),
+		c.Handshake.Validate(),
+		c.Conn.Validate(),
+		c.RateLimit.Validate(),
+		c.Chat.Validate(),
+		c.Storage.Validate(),
+		c.Snake.Validate(),
+		c.Leaderboard.Validate(),
+		c.Caro.Validate(),
+		c.Graph.Validate(),
+		c.validateChatFits(),
+	)
+}
+
+// chatEnvelope bounds the bytes of a chat message besides its text.
+const chatEnvelope = 64
+
+// validateChatFits checks that a chat message of chat.maxLength characters,
+// each up to 4 bytes of UTF-8, is not cut off by conn.readLimit, which
+// closes the connection.
+func (c Config) validateChatFits() error {
+	if need := 4*int64(c.Chat.MaxLength) + chatEnvelope; c.Conn.ReadLimit < need {
+		return fmt.Errorf("conn.readLimit (%d) must be at least %d bytes to fit chat messages of chat.maxLength (%d) characters",
+			c.Conn.ReadLimit, need, c.Chat.MaxLength)
+	}
+	return nil
+}
+
+func (s Server) Validate() error {
+	var errs []error
+	if s.Addr == "" {
+		errs = append(errs, errors.New("server.addr must not be empty"))
+	}
+	if s.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("server.shutdownTimeout must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+func (l Log) Validate() error {
+	var errs []error
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	if l.Format != "text" && l.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format must be \"text\" or \"json\", got %q", l.Format))
+	}
+	return errors.Join(errs...)
+}
+
+func (h Health) Validate() error {
+	if h.StallIntervals < 2 {
+		return errors.New("health.stallIntervals must be at least 2")
+	}
+	return nil
+}
+
+func (a Admin) Validate() error {
+	if a.Token != "" && len(a.Token) < 16 {
+		return errors.New("admin.token must be at least 16 characters")
+	}
+	return nil
+}
+
+func (a Auth) Validate() error {
+	var errs []error
+	if a.Secret != "" && len(a.Secret) < 32 {
+		errs = append(errs, errors.New("auth.secret must be at least 32 characters"))
+	}
+	if a.TokenTTL <= 0 {
+		errs = append(errs, errors.New("auth.tokenTTL must be positive"))
+	}
+	if a.LoginsPerMinute < 1 {
+		errs = append(errs, errors.New("auth.loginsPerMinute must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
+func (h Handshake) Validate() error {
+	var errs []error
+	if h.MaxConns < 1 || h.MaxConnsPerIP < 1 {
+		errs = append(errs, errors.New("handshake.maxConns and handshake.maxConnsPerIP must be at least 1"))
+	}
+	if h.MaxConnsPerIP > h.MaxConns {
+		errs = append(errs, fmt.Errorf("handshake.maxConnsPerIP (%d) must not exceed handshake.maxConns (%d)", h.MaxConnsPerIP, h.MaxConns))
+	}
+	if h.Timeout <= 0 {
+		errs = append(errs, errors.New("handshake.timeout must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+func (c Conn) Validate() error {
+	var errs []error
+	if c.PingInterval <= 0 || c.WriteTimeout <= 0 {
+		errs = append(errs, errors.New("conn.pingInterval and conn.writeTimeout must be positive"))
+	}
+	if c.ReadTimeout <= c.PingInterval {
+		errs = append(errs, fmt.Errorf("conn.readTimeout (%s) must be longer than conn.pingInterval (%s)", c.ReadTimeout, c.PingInterval))
+	}
+	if c.ReadLimit < 64 {
+		errs = append(errs, errors.New("conn.readLimit must be at least 64 bytes"))
+	}
+	if c.SendQueueSize < 1 {
+		errs = append(errs, errors.New("conn.sendQueueSize must be at least 1"))
+	}
+	if c.CompressionLevel < -2 || c.CompressionLevel > 9 {
+		errs = append(errs, errors.New("conn.compressionLevel must be between -2 and 9"))
+	}
+	if c.CompressionThreshold < 0 {
+		errs = append(errs, errors.New("conn.compressionThreshold must not be negative"))
+	}
+	if c.ResumeGrace < 0 {
+		errs = append(errs, errors.New("conn.resumeGrace must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (r RateLimit) Validate() error {
+	if r.MaxInvalidDirections < 1 {
+		return errors.New("rateLimit.maxInvalidDirections must be at least 1")
+	}
+	if r.Rate < 0 {
+		return errors.New("rateLimit.rate must not be negative")
+	}
+	if r.Rate == 0 {
+		return nil
+	}
+	var errs []error
+	if r.Burst < 1 {
+		errs = append(errs, errors.New("rateLimit.burst must be at least 1"))
+	}
+	if r.DropAfter < 1 || r.DisconnectAfter < r.DropAfter {
+		errs = append(errs, errors.New("rateLimit.dropAfter must be at least 1 and at most rateLimit.disconnectAfter"))
+	}
+	if r.Cooldown <= 0 {
+		errs = append(errs, errors.New("rateLimit.cooldown must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+func (s Snake) Validate() error {
+	var errs []error
+	if s.InitSize < 1 || s.InitSize > 100 {
+		errs = append(errs, errors.New("snake.initSize must be between 1 and 100"))
+	}
+	// Snakes spawn at least initSize cells away from both side walls.
+	if s.NumCells <= 2*s.InitSize || s.NumCells > 1000 {
+		errs = append(errs, fmt.Errorf("snake.numCells must be between %d and 1000", 2*s.InitSize+1))
+	}
+	if s.Foods < 0 || s.Foods > 1000 {
+		errs = append(errs, errors.New("snake.foods must be between 0 and 1000"))
+	}
+	if s.TickInterval < 10*time.Millisecond {
+		errs = append(errs, errors.New("snake.tickInterval must be at least 10ms"))
+	}
+	if s.KeyframeInterval < 1 {
+		errs = append(errs, errors.New("snake.keyframeInterval must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
+func (l Leaderboard) Validate() error {
+	if l.Size < 1 {
+		return errors.New("leaderboard.size must be at least 1")
+	}
+	return nil
+}
+
+func (c Caro) Validate() error {
+	var errs []error
+	if c.BoardSize < 3 || c.BoardSize > 100 {
+		errs = append(errs, errors.New("caro.boardSize must be between 3 and 100"))
+	}
+	if c.WinCondition < 3 || c.WinCondition > c.BoardSize {
+		errs = append(errs, errors.New("caro.winCondition must be between 3 and caro.boardSize"))
+	}
+	return errors.Join(errs...)
+}
+
+func (s Storage) Validate() error {
+	var errs []error
+	if s.History < 1 {
+		errs = append(errs, errors.New("storage.history must be at least 1"))
+	}
+	if s.QueueSize < 1 {
+		errs = append(errs, errors.New("storage.queueSize must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
+func (c Chat) Validate() error {
+	var errs []error
+	if c.MaxLength < 1 {
+		errs = append(errs, errors.New("chat.maxLength must be at least 1"))
+	}
+	if c.History < 0 {
+		errs = append(errs, errors.New("chat.history must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (g Graph) Validate() error {
+	if g.HitDistance <= 0 {
+		return errors.New("graph.hitDistance must be positive")
+	}
+	return nil
+}
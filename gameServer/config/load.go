@@ -0,0 +1,235 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix is prepended to every environment variable, e.g. the key
+// "snake.tickInterval" is read from GAMESERVER_SNAKE_TICKINTERVAL.
+const envPrefix = "GAMESERVER_"
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	stringsType  = reflect.TypeOf([]string(nil))
+)
+
+// Load builds the configuration from defaults, the JSON file named by the
+// -config flag or GAMESERVER_CONFIG, the environment and finally args.
+// Every key is also a flag, e.g. -snake.tickInterval=50ms.
+func Load(args []string) (Config, error) {
+	cfg := Default()
+	fields := fieldsOf(&cfg)
+
+	fs := flag.NewFlagSet("gameserver", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path to a JSON config file")
+	for _, f := range fields {
+		fs.String(f.key, f.String(), "")
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *path != "" {
+		if err := loadFile(fields, *path); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, f := range fields {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.key, ".", "_"))
+		if v, ok := os.LookupEnv(name); ok {
+			if err := f.set(v); err != nil {
+				return cfg, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(fl *flag.Flag) {
+		if f, ok := fields[fl.Name]; ok && err == nil {
+			if e := f.set(fl.Value.String()); e != nil {
+				err = fmt.Errorf("-%s: %w", fl.Name, e)
+			}
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Override applies the values keyed by JSON field name to rules, one of
+// the rule structs, and validates the result. rules is only changed if
+// every value applies and the result is valid. It is used for per-room
+// rule overrides; only fields tagged `override:"room"` may be set.
+func Override[R interface{ Validate() error }](rules *R, values map[string]string) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	changed := *rules
+	fields := fieldsOf(&changed)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f, ok := fields[k]
+		if !ok {
+			return fmt.Errorf("unknown rule %q", k)
+		}
+		if !f.overridable {
+			return fmt.Errorf("rule %q cannot be overridden per room", k)
+		}
+		if err := f.set(values[k]); err != nil {
+			return fmt.Errorf("rule %s: %w", k, err)
+		}
+	}
+	if err := changed.Validate(); err != nil {
+		return err
+	}
+	*rules = changed
+	return nil
+}
+
+func loadFile(fields map[string]field, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var tree map[string]any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	flatten("", tree, values)
+	for k, v := range values {
+		f, ok := fields[k]
+		if !ok {
+			return fmt.Errorf("%s: unknown key %q", path, k)
+		}
+		if err := f.set(v); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, k, err)
+		}
+	}
+	return nil
+}
+
+func flatten(prefix string, tree map[string]any, out map[string]string) {
+	for k, v := range tree {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case map[string]any:
+			flatten(k, v, out)
+		case float64:
+			out[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			out[k] = strings.Join(items, ",")
+		default:
+			out[k] = fmt.Sprint(v)
+		}
+	}
+}
+
+// field is one settable leaf of a config struct, keyed by the dotted path
+// of JSON field names.
+type field struct {
+	key string
+	v   reflect.Value
+	// overridable is set by the tag `override:"room"` on rules that may be
+	// changed per room.
+	overridable bool
+}
+
+func fieldsOf(ptr any) map[string]field {
+	fields := make(map[string]field)
+	collect("", reflect.ValueOf(ptr).Elem(), fields)
+	return fields
+}
+
+func collect(prefix string, v reflect.Value, out map[string]field) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if fv := v.Field(i); fv.Kind() == reflect.Struct {
+			collect(key, fv, out)
+		} else {
+			out[key] = field{key: key, v: fv, overridable: t.Field(i).Tag.Get("override") == "room"}
+		}
+	}
+}
+
+func (f field) String() string {
+	if f.v.Type() == durationType {
+		return time.Duration(f.v.Int()).String()
+	}
+	if items, ok := f.v.Interface().([]string); ok {
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(f.v.Interface())
+}
+
+func (f field) set(s string) error {
+	s = strings.TrimSpace(s)
+	switch {
+	case f.v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(int64(d))
+	case f.v.Kind() == reflect.String:
+		f.v.SetString(s)
+	case f.v.Type() == stringsType:
+		// Lists are comma separated in flags and the environment.
+		items := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.v.Set(reflect.ValueOf(items))
+	case f.v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetBool(b)
+	case f.v.CanInt():
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(n)
+	case f.v.CanFloat():
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.v.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %s", f.v.Type())
+	}
+	return nil
+}
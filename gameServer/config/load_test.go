@@ -0,0 +1,41 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOverride(t *testing.T) {
+	rules := Default().Snake
+	err := Override(&rules, map[string]string{"numCells": "60", "tickInterval": "50ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.NumCells != 60 || rules.TickInterval != 50*time.Millisecond {
+		t.Errorf("rules = %+v, want numCells 60 and tickInterval 50ms", rules)
+	}
+}
+
+func TestOverrideRejected(t *testing.T) {
+	tests := []map[string]string{
+		{"boardSize": "2"},                       // invalid
+		{"boardSize": "20", "winCondition": "x"}, // not a number
+		{"boardSize": "20", "nope": "1"},         // unknown
+	}
+	for _, values := range tests {
+		rules := Default().Caro
+		if err := Override(&rules, values); err == nil {
+			t.Errorf("Override(%v) succeeded", values)
+		}
+		if rules != Default().Caro {
+			t.Errorf("Override(%v) failed but changed the rules to %+v", values, rules)
+		}
+	}
+}
+
+func TestOverrideNotAllowed(t *testing.T) {
+	rules := Default().Snake
+	if err := Override(&rules, map[string]string{"keyframeInterval": "1"}); err == nil {
+		t.Error("keyframeInterval was overridden, it is not tagged override:\"room\"")
+	}
+}
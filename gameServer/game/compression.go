@@ -0,0 +1,59 @@
+package game
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// meteredConn counts the bytes written to a hijacked connection, so the
+// compression ratio can be measured on the wire.
+type meteredConn struct {
+	net.Conn
+	// written is atomic as the read goroutine still answers close frames.
+	written atomic.Int64
+	deflate bool // permessage-deflate was negotiated
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// meteredWriter hands a meteredConn to the websocket upgrader when it
+// hijacks the connection.
+type meteredWriter struct {
+	http.ResponseWriter
+	conn *meteredConn
+}
+
+func (w *meteredWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn.Conn = conn
+	return w.conn, rw, nil
+}
+
+// deflateOffered reports whether the client offered permessage-deflate, in
+// which case the upgrader agrees to it when compression is enabled.
+func deflateOffered(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-Websocket-Extensions") {
+		for _, ext := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
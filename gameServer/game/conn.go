@@ -0,0 +1,175 @@
+package game
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/simplegameserver/gameserver/auth"
+	"github.com/simplegameserver/gameserver/protocol"
+)
+
+// Upgrade upgrades the request to a websocket through the shared Gate,
+// with the connection settings of m. It is meant for endpoints that are
+// not a Game, such as the caro matchmaking queue; the result must be
+// wrapped with m.NewConn, which frees the Gate slot on close.
+func (m *Manager) Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	conn, err := m.gate.Upgrade(w, r, m.name)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(m.conn.ReadLimit)
+	return conn, nil
+}
+
+// HandshakeTimeout is how long a client may take to send its init message.
+func (m *Manager) HandshakeTimeout() time.Duration {
+	return m.gate.cfg.Timeout
+}
+
+// NewConn starts a write pump for ws with the connection settings of m.
+func (m *Manager) NewConn(ws *websocket.Conn) *Conn {
+	return m.newConn(ws, m.log.With("remote_addr", ws.RemoteAddr().String()))
+}
+
+func (m *Manager) newConn(ws *websocket.Conn, logger *slog.Logger) *Conn {
+	return newConn(ws, m.name, m.conn, logger, func() { m.gate.Release(ws) })
+}
+
+// serve upgrades the request, waits for the init message, joins the player
+// to the room's game and forwards every following message until the
+// connection drops. serve is the only reader of the connection, the Conn
+// write pump the only writer.
+func (m *Manager) serve(room *Room, session auth.Session, w http.ResponseWriter, r *http.Request) {
+	g := room.Game
+
+	conn, err := m.Upgrade(w, r)
+	if err != nil {
+		room.log.Warn("websocket upgrade failed", "remote_addr", r.RemoteAddr, "err", err)
+		return
+	}
+
+	readTimeout := m.conn.ReadTimeout
+	conn.SetReadDeadline(time.Now().Add(m.HandshakeTimeout()))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		return nil
+	})
+
+	playerID := session.PlayerID
+	c := m.newConn(conn, room.log.With("remote_addr", conn.RemoteAddr().String(), "player_id", playerID))
+	if !m.track(room, c) {
+		c.CloseWithReason(websocket.CloseServiceRestart, shutdownReason)
+		return
+	}
+	defer m.untrack(room, c)
+
+	_, init, err := conn.ReadMessage()
+	if err != nil {
+		c.log.Info("failed to read init message", "err", err)
+		c.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+	var supported []string
+	if capable, ok := g.(Capable); ok {
+		supported = capable.Capabilities()
+	}
+	if !c.Handshake(init, supported, playerID) {
+		return
+	}
+
+	if !m.join(room, c, session, init) {
+		return
+	}
+	defer c.Close()
+	if !c.Spectator() {
+		playersGauge.Inc(m.name)
+		defer playersGauge.Dec(m.name)
+	}
+
+	limiter := newLimiter(m.rateLimit)
+	var readErr error
+read:
+	for {
+		frameType, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				c.log.Info("read failed", "err", err)
+				droppedConnections.Inc(m.name, "read_error")
+			}
+			readErr = err
+			break
+		}
+		now := time.Now()
+		conn.SetReadDeadline(now.Add(readTimeout))
+
+		msgType, _ := protocol.TypeOf(data) // malformed messages share the "" bucket
+		switch limiter.check(msgType, now) {
+		case warnMessage:
+			rateLimited.Inc(m.name, "warn")
+			c.SendJSON(protocol.ErrorFrame(protocol.ErrRateLimited))
+		case dropMessage:
+			rateLimited.Inc(m.name, "drop")
+			continue
+		case disconnect:
+			rateLimited.Inc(m.name, "disconnect")
+			c.log.Warn("rate limit exceeded, disconnecting")
+			c.SendJSON(protocol.ErrorFrame(protocol.ErrRateLimited))
+			c.Disconnect("rate limited")
+			break read
+		}
+		if binary := frameType == websocket.BinaryMessage; binary != protocol.IsBinary(data) || binary && !c.Has(protocol.CapBinary) {
+			c.SendJSON(protocol.ErrorFrame(protocol.ErrBinaryNotAgreed))
+			continue
+		}
+
+		if !m.beginMessage() {
+			// Shutting down: the message arrived too late to be handled.
+			break
+		}
+		err = g.HandleMessage(playerID, data)
+		m.inflight.Done()
+		if err != nil {
+			c.log.Info("message rejected", "type", msgType, "err", err)
+			c.SendJSON(protocol.ErrorFrame(err))
+			if protocol.IsFatal(err) {
+				c.Disconnect("invalid input")
+				break
+			}
+		}
+	}
+	m.leave(room, c, playerID, readErr)
+}
+
+// Handshake negotiates the protocol version and capabilities of the init
+// message and answers with an initAck. Incompatible clients get an error
+// frame telling them to upgrade and are disconnected. Capabilities are
+// recorded on c before it is handed to the game. Compression is agreed
+// when the websocket handshake negotiated permessage-deflate.
+func (c *Conn) Handshake(init []byte, supported []string, playerID string) bool {
+	if c.wire != nil && c.wire.deflate {
+		supported = append(slices.Clip(supported), protocol.CapCompression)
+	}
+	hello, caps, err := protocol.Negotiate(init, supported)
+	if err != nil {
+		c.log.Info("handshake rejected", "version", hello.Version, "err", err)
+		c.SendJSON(protocol.ErrorFrame(err))
+		c.CloseWithReason(websocket.ClosePolicyViolation, "handshake rejected")
+		return false
+	}
+	c.caps = caps
+	c.role = hello.Role
+	c.SendJSON(protocol.InitAck{
+		Type:         "initAck",
+		Version:      protocol.Version,
+		Capabilities: caps,
+		Role:         hello.Role,
+		PlayerID:     playerID,
+	})
+	return true
+}
@@ -0,0 +1,74 @@
+// Package game holds the pieces shared by every game served over websocket:
+// the Game interface, the registry main.go iterates over, the rooms each game
+// is split into and the connection lifecycle (upgrade, init, read loop, write pump).
+package game
+
+import (
+	"errors"
+	"time"
+
+	"github.com/simplegameserver/gameserver/auth"
+)
+
+// Game is one running instance of a game. Implementations guard their own
+// state; every method may be called from any goroutine.
+type Game interface {
+	// Join decodes the init message sent on conn and adds the player of the
+	// verified session to the game. session.PlayerID is passed to the
+	// other methods; the init message never chooses the player ID. A
+	// returned error is sent to the client as an error frame. Clients
+	// with conn.Spectator() only watch: they get what players get but
+	// cannot act and are not counted as players.
+	Join(conn *Conn, session auth.Session, init []byte) error
+	// Leave removes the player and notifies the remaining ones.
+	Leave(playerID string)
+	// HandleMessage processes one message read from the player's connection.
+	// A returned error is sent to the client as an error frame; if it is
+	// marked with protocol.Fatal the client is then disconnected.
+	HandleMessage(playerID string, data []byte) error
+	// Tick advances the game by one step. It is only called when
+	// TickInterval returns a positive duration.
+	Tick()
+	TickInterval() time.Duration
+	// Snapshot returns the current game state as it is sent to clients.
+	Snapshot() any
+}
+
+// Capable is implemented by games that support optional protocol
+// capabilities. The ones agreed with a client at handshake are reported by
+// its Conn.Has.
+type Capable interface {
+	Capabilities() []string
+}
+
+// Moderator is implemented by games that can be moderated from the admin API.
+type Moderator interface {
+	// Players returns the IDs of the players in the game.
+	Players() []string
+	// Kick disconnects the player or spectator and removes them as if they
+	// had left. It reports whether they were in the game.
+	Kick(playerID string) bool
+	// Command runs a game specific admin command, such as "reset" in caro.
+	// It returns ErrUnknownCommand for commands the game does not support.
+	Command(name string) error
+}
+
+// Resumable is implemented by games that hold the place of a player whose
+// connection was lost, so that reconnecting with the same session within
+// conn.resumeGrace resumes the game. Other games remove the player as soon
+// as the connection ends.
+type Resumable interface {
+	// Suspend is called instead of Leave when the player's connection was
+	// lost. The game keeps the player's state; their Conn is closed and
+	// drops whatever is still sent to it. Leave is called if they do not
+	// come back in time.
+	Suspend(playerID string)
+	// Resume attaches conn to a player the game still holds, whether
+	// suspended or on an older connection, and sends them the full state.
+	// It returns false if the player is gone, e.g. after a kick; the
+	// connection then joins as a new player.
+	Resume(conn *Conn, playerID string) bool
+}
+
+// ErrUnknownCommand is returned by Moderator.Command.
+var ErrUnknownCommand = errors.New("unknown command")
@@ -0,0 +1,164 @@
+package game
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/simplegameserver/gameserver/config"
+)
+
+var (
+	errOriginNotAllowed = errors.New("origin not allowed")
+	errServerFull       = errors.New("server full")
+	errTooManyConns     = errors.New("too many connections from this address")
+)
+
+// Gate is the websocket upgrader shared by every game of a Registry, so
+// the origin allowlist and the connection caps apply to the whole server.
+// Rejected handshakes get a plain HTTP error: 403 for a foreign origin, 503
+// when the server is full and 429 when the client's IP is.
+type Gate struct {
+	cfg      config.Handshake
+	conn     config.Conn
+	upgrader websocket.Upgrader
+
+	mu    sync.Mutex
+	total int                        // open and upgrading connections
+	perIP map[string]int             // total by client IP
+	conns map[*websocket.Conn]string // client IP of open connections
+}
+
+func NewGate(cfg config.Handshake, conn config.Conn) *Gate {
+	return &Gate{
+		cfg:  cfg,
+		conn: conn,
+		upgrader: websocket.Upgrader{
+			HandshakeTimeout:  cfg.Timeout,
+			EnableCompression: conn.Compression,
+			// The origin was already checked by Upgrade, with a clearer error.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		conns: make(map[*websocket.Conn]string),
+		perIP: make(map[string]int),
+	}
+}
+
+// Upgrade checks the origin and the connection caps, then upgrades the
+// request. game labels the rejection metrics. The slot taken by the
+// connection is held until Release is called.
+func (g *Gate) Upgrade(w http.ResponseWriter, r *http.Request, game string) (*websocket.Conn, error) {
+	if !originAllowed(g.cfg.AllowedOrigins, r) {
+		handshakesRejected.Inc(game, "origin")
+		http.Error(w, errOriginNotAllowed.Error(), http.StatusForbidden)
+		return nil, errOriginNotAllowed
+	}
+
+	ip := clientIP(r)
+	g.mu.Lock()
+	switch {
+	case g.total >= g.cfg.MaxConns:
+		g.mu.Unlock()
+		handshakesRejected.Inc(game, "server_full")
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, errServerFull.Error(), http.StatusServiceUnavailable)
+		return nil, errServerFull
+	case g.perIP[ip] >= g.cfg.MaxConnsPerIP:
+		g.mu.Unlock()
+		handshakesRejected.Inc(game, "ip_limit")
+		http.Error(w, errTooManyConns.Error(), http.StatusTooManyRequests)
+		return nil, errTooManyConns
+	}
+	// Reserve the slot before the upgrade so concurrent handshakes cannot
+	// exceed the caps.
+	g.total++
+	g.perIP[ip]++
+	g.mu.Unlock()
+
+	metered := &meteredWriter{ResponseWriter: w, conn: &meteredConn{
+		deflate: g.conn.Compression && deflateOffered(r),
+	}}
+	ws, err := g.upgrader.Upgrade(metered, r, nil)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err != nil {
+		g.releaseIP(ip)
+		return nil, err
+	}
+	if metered.conn.deflate {
+		ws.SetCompressionLevel(g.conn.CompressionLevel)
+	}
+	g.conns[ws] = ip
+	return ws, nil
+}
+
+// Release frees the slot of a connection returned by Upgrade. It is safe
+// to call more than once.
+func (g *Gate) Release(ws *websocket.Conn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ip, ok := g.conns[ws]; ok {
+		delete(g.conns, ws)
+		g.releaseIP(ip)
+	}
+}
+
+// releaseIP frees a slot of ip. It must be called with g.mu held.
+func (g *Gate) releaseIP(ip string) {
+	g.total--
+	if g.perIP[ip]--; g.perIP[ip] <= 0 {
+		delete(g.perIP, ip)
+	}
+}
+
+// CORS lets the browser origins allowed by cfg, the same as for websockets,
+// call the HTTP endpoint next, which the client calls from its own origin.
+// Requests from other origins get 403 and preflight requests are answered
+// without calling next.
+func CORS(cfg config.Handshake, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !originAllowed(cfg.AllowedOrigins, r) {
+			http.Error(w, errOriginNotAllowed.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func originAllowed(origins []string, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	// Same-origin requests are always fine, like the upgrader's default.
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
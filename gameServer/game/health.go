@@ -0,0 +1,99 @@
+package game
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// RoomStatus is the health of one room, reported by GET /admin/health.
+type RoomStatus struct {
+	ID       string     `json:"id"`
+	Players  int        `json:"players"`
+	LastTick *time.Time `json:"lastTick,omitempty"`
+	Stalled  bool       `json:"stalled"`
+}
+
+// GameStatus is the health of one registered game. /healthz and /readyz
+// only report the totals; Rooms is left out there, see Summary.
+type GameStatus struct {
+	Name         string       `json:"name"`
+	Closing      bool         `json:"closing"`
+	Stalled      bool         `json:"stalled"`
+	RoomCount    int          `json:"roomCount"`
+	StalledRooms int          `json:"stalledRooms"`
+	Players      int          `json:"players"`
+	Rooms        []RoomStatus `json:"rooms,omitempty"`
+}
+
+// Ready reports whether the game accepts players and none of its game
+// loops has stalled.
+func (s GameStatus) Ready() bool {
+	return !s.Closing && !s.Stalled
+}
+
+// Summary returns s without the status of each room, which would tell
+// anyone the room IDs to join.
+func (s GameStatus) Summary() GameStatus {
+	s.Rooms = nil
+	return s
+}
+
+// Status reports the health of every room. A room is stalled when its game
+// loop has not completed a tick for stallIntervals tick intervals, e.g.
+// because a Tick is blocked on a lock.
+func (m *Manager) Status() GameStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	status := GameStatus{Name: m.name, Closing: m.closing, Rooms: []RoomStatus{}}
+	for _, room := range m.rooms {
+		rs := RoomStatus{ID: room.ID, Players: room.players}
+		if interval := room.Game.TickInterval(); interval > 0 {
+			last := time.Unix(0, room.lastTick.Load())
+			rs.LastTick = &last
+			rs.Stalled = m.stallIntervals > 0 && now.Sub(last) > time.Duration(m.stallIntervals)*interval
+		}
+		status.Stalled = status.Stalled || rs.Stalled
+		status.RoomCount++
+		status.Players += rs.Players
+		if rs.Stalled {
+			status.StalledRooms++
+		}
+		status.Rooms = append(status.Rooms, rs)
+	}
+	return status
+}
+
+// Healthz answers 200 as long as the process serves HTTP, with the totals
+// of every game.
+func (r *Registry) Healthz(w http.ResponseWriter, req *http.Request) {
+	r.writeStatus(w, false)
+}
+
+// Readyz answers 503 while shutting down or when a game loop has stalled.
+func (r *Registry) Readyz(w http.ResponseWriter, req *http.Request) {
+	r.writeStatus(w, true)
+}
+
+func (r *Registry) writeStatus(w http.ResponseWriter, readiness bool) {
+	resp := struct {
+		Status string       `json:"status"`
+		Games  []GameStatus `json:"games"`
+	}{Status: "ok", Games: []GameStatus{}}
+
+	code := http.StatusOK
+	for _, m := range r.Managers() {
+		s := m.Status()
+		if readiness && !s.Ready() {
+			resp.Status = "unready"
+			code = http.StatusServiceUnavailable
+		}
+		resp.Games = append(resp.Games, s.Summary())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,27 @@
+package game
+
+import "github.com/simplegameserver/gameserver/metrics"
+
+var (
+	// Room IDs are not a label: /metrics is public and they let anyone
+	// join rooms created by an admin or the caro queue.
+	playersGauge = metrics.NewGauge("gameserver_players",
+		"Players currently joined, not counting spectators, by game.", "game")
+	tickDuration = metrics.NewHistogram("gameserver_tick_duration_seconds",
+		"Time spent in one game loop tick.", metrics.DurationBuckets, "game")
+	outboundBytes = metrics.NewCounter("gameserver_outbound_bytes_total",
+		"Bytes of websocket messages written to clients.", "game")
+	outboundWireBytes = metrics.NewCounter("gameserver_outbound_wire_bytes_total",
+		"Bytes written to client sockets for websocket messages, after compression and framing.", "game")
+	compressionRatio = metrics.NewHistogram("gameserver_compression_ratio",
+		"Message size divided by the bytes written for it, for messages sent compressed.",
+		[]float64{1, 1.5, 2, 3, 5, 10, 20}, "game")
+	droppedConnections = metrics.NewCounter("gameserver_dropped_connections_total",
+		"Connections closed by the server because of an error, by reason.", "game", "reason")
+	rateLimited = metrics.NewCounter("gameserver_rate_limited_messages_total",
+		"Messages over the rate limit, by the action taken: warn, drop or disconnect.", "game", "action")
+	playersResumed = metrics.NewCounter("gameserver_players_resumed_total",
+		"Players that reconnected within the grace period and resumed their game.", "game")
+	handshakesRejected = metrics.NewCounter("gameserver_handshakes_rejected_total",
+		"Websocket handshakes refused by the origin allowlist or connection caps, by reason.", "game", "reason")
+)
@@ -0,0 +1,82 @@
+package game
+
+import (
+	"math"
+	"time"
+
+	"github.com/simplegameserver/gameserver/config"
+)
+
+// maxBuckets bounds the buckets of one connection; message types beyond it
+// share a single bucket, so a client cannot grow the map by inventing types.
+const maxBuckets = 16
+
+// verdict is what the read loop does with a message.
+type verdict int
+
+const (
+	allowMessage verdict = iota
+	warnMessage          // handled, but the client is told it is rate limited
+	dropMessage          // discarded
+	disconnect           // the client is disconnected
+)
+
+// limiter is a token bucket per message type of one connection. Each
+// message over the limit is a violation: the first ones are only warned
+// about, after DropAfter they are dropped and after DisconnectAfter the
+// client is disconnected. Violations are forgotten after Cooldown without
+// any. A limiter is only used by the connection's read loop.
+type limiter struct {
+	cfg     config.RateLimit
+	buckets map[string]*bucket
+
+	violations    int
+	lastViolation time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(cfg config.RateLimit) *limiter {
+	return &limiter{cfg: cfg, buckets: make(map[string]*bucket)}
+}
+
+// check takes a token for a message of msgType received at now.
+func (l *limiter) check(msgType string, now time.Time) verdict {
+	if l.cfg.Rate <= 0 {
+		return allowMessage
+	}
+
+	b, ok := l.buckets[msgType]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			msgType = "\x00other"
+		}
+		if b, ok = l.buckets[msgType]; !ok {
+			b = &bucket{tokens: float64(l.cfg.Burst), last: now}
+			l.buckets[msgType] = b
+		}
+	}
+	b.tokens = math.Min(float64(l.cfg.Burst), b.tokens+now.Sub(b.last).Seconds()*l.cfg.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return allowMessage
+	}
+
+	if now.Sub(l.lastViolation) > l.cfg.Cooldown {
+		l.violations = 0
+	}
+	l.violations++
+	l.lastViolation = now
+	switch {
+	case l.violations >= l.cfg.DisconnectAfter:
+		return disconnect
+	case l.violations >= l.cfg.DropAfter:
+		return dropMessage
+	default:
+		return warnMessage
+	}
+}
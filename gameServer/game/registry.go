@@ -0,0 +1,133 @@
+package game
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/simplegameserver/gameserver/auth"
+	"github.com/simplegameserver/gameserver/chat"
+	"github.com/simplegameserver/gameserver/config"
+	"github.com/simplegameserver/gameserver/storage"
+)
+
+// Env describes the room a Factory is asked to create a game for.
+type Env struct {
+	Room string
+	// Logger carries the game and room attributes.
+	Logger *slog.Logger
+	// Overrides holds the rule overrides an admin created the room with, see
+	// config.Override. It may be nil.
+	Overrides map[string]string
+	// Chat is the chat of the room. Games handle "chat" messages with it
+	// and send its history to joining players.
+	Chat *chat.Room
+	// Storage is where the game saves its results.
+	Storage storage.Storage
+}
+
+// Factory creates a new, empty instance of a game. It is called once per
+// room.
+type Factory func(env Env) (Game, error)
+
+// Registry keeps the games served by this process in registration order.
+type Registry struct {
+	conn   config.Conn
+	health config.Health
+	limit  config.RateLimit
+	chat   config.Chat
+	issuer *auth.Issuer
+	store  storage.Storage
+	gate   *Gate
+
+	mu          sync.Mutex
+	managers    []*Manager
+	chatFilters []chat.Filter
+}
+
+// NewRegistry creates a registry whose games share the handshake rules,
+// connection settings and rate limits of cfg, authenticate players with
+// sessions and save their results to store.
+func NewRegistry(cfg config.Config, sessions *auth.Issuer, store storage.Storage) *Registry {
+	return &Registry{
+		conn:   cfg.Conn,
+		health: cfg.Health,
+		limit:  cfg.RateLimit,
+		chat:   cfg.Chat,
+		issuer: sessions,
+		store:  store,
+		gate:   NewGate(cfg.Handshake, cfg.Conn),
+	}
+}
+
+// Register adds a game under name. The name is also the HTTP path the game
+// is served on. Registering the same name twice is a programming error.
+func (r *Registry) Register(name string, newGame Factory) *Manager {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, m := range r.managers {
+		if m.Name() == name {
+			panic(fmt.Sprintf("game: %q registered twice", name))
+		}
+	}
+	m := NewManager(name, newGame, r.conn, r.issuer, r.gate)
+	m.stallIntervals = r.health.StallIntervals
+	m.rateLimit = r.limit
+	m.chat = r.chat
+	m.store = r.store
+	m.chatFilters = r.chatFilters
+	r.managers = append(r.managers, m)
+	return m
+}
+
+// AddChatFilter adds a filter every chat message passes through after the
+// configured ones, such as a profanity service. It only applies to games
+// registered afterwards.
+func (r *Registry) AddChatFilter(f chat.Filter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chatFilters = append(r.chatFilters, f)
+}
+
+// Get returns the room manager of the game registered under name.
+func (r *Registry) Get(name string) (*Manager, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, m := range r.managers {
+		if m.Name() == name {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// Managers returns the room managers of every registered game.
+func (r *Registry) Managers() []*Manager {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*Manager(nil), r.managers...)
+}
+
+// Shutdown shuts every game down concurrently, see Manager.Shutdown.
+func (r *Registry) Shutdown(ctx context.Context) error {
+	managers := r.Managers()
+	errs := make([]error, len(managers))
+
+	var wg sync.WaitGroup
+	for i, m := range managers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.Shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", m.Name(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
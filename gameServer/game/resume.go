@@ -0,0 +1,147 @@
+package game
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/simplegameserver/gameserver/auth"
+	"github.com/simplegameserver/gameserver/protocol"
+)
+
+// heldPlayer is a player of a Resumable game. conn is their latest
+// connection; timer runs while they are suspended.
+type heldPlayer struct {
+	conn  *Conn
+	timer *time.Timer
+}
+
+// join adds the player of c to the room's game, or resumes them if the
+// game still holds them, and reports whether they are in. Rejected
+// connections get an error frame and are closed.
+func (m *Manager) join(room *Room, c *Conn, session auth.Session, init []byte) bool {
+	if room.reserved != nil && !room.reserved[session.PlayerID] && !c.Spectator() {
+		c.log.Info("join rejected", "err", protocol.ErrRoomReserved)
+		c.SendJSON(protocol.ErrorFrame(protocol.ErrRoomReserved))
+		c.CloseWithReason(websocket.ClosePolicyViolation, "join rejected")
+		return false
+	}
+	g := room.Game
+	resumable, ok := g.(Resumable)
+	if !ok || m.conn.ResumeGrace <= 0 || c.Spectator() {
+		return m.joinGame(room, c, session, init)
+	}
+
+	room.resume.Lock()
+	defer room.resume.Unlock()
+
+	playerID := session.PlayerID
+	if h, ok := room.held[playerID]; ok {
+		if h.timer != nil {
+			// A timer that already fired finds h changed and does nothing.
+			h.timer.Stop()
+			h.timer = nil
+			m.release(room)
+		}
+		if resumable.Resume(c, playerID) {
+			// The old connection may not have noticed it is gone yet.
+			h.conn.Disconnect("replaced")
+			h.conn = c
+			playersResumed.Inc(m.name)
+			return true
+		}
+		delete(room.held, playerID)
+	}
+	if !m.joinGame(room, c, session, init) {
+		return false
+	}
+	room.held[playerID] = &heldPlayer{conn: c}
+	return true
+}
+
+func (m *Manager) joinGame(room *Room, c *Conn, session auth.Session, init []byte) bool {
+	if err := room.Game.Join(c, session, init); err != nil {
+		c.log.Info("join rejected", "err", err)
+		c.SendJSON(protocol.ErrorFrame(err))
+		c.CloseWithReason(websocket.ClosePolicyViolation, "join rejected")
+		return false
+	}
+	return true
+}
+
+// leave is called when the connection c of playerID ends, readErr being
+// the error that ended the read loop, if any. A Resumable game suspends the
+// player if the connection was lost and the room is kept until the grace
+// period ends; otherwise the player leaves.
+func (m *Manager) leave(room *Room, c *Conn, playerID string, readErr error) {
+	g := room.Game
+	resumable, ok := g.(Resumable)
+	if !ok || m.conn.ResumeGrace <= 0 || c.Spectator() {
+		g.Leave(playerID)
+		return
+	}
+
+	room.resume.Lock()
+	defer room.resume.Unlock()
+
+	h, ok := room.held[playerID]
+	if !ok || h.conn != c {
+		return // replaced by a newer connection
+	}
+	if !c.lost(readErr) {
+		delete(room.held, playerID)
+		g.Leave(playerID)
+		return
+	}
+
+	resumable.Suspend(playerID)
+	m.hold(room)
+	h.timer = time.AfterFunc(m.conn.ResumeGrace, func() {
+		room.resume.Lock()
+		defer room.resume.Unlock()
+		if room.held[playerID] != h || h.conn != c {
+			return // resumed meanwhile
+		}
+		delete(room.held, playerID)
+		g.Leave(playerID)
+		c.log.Info("grace period over, player left")
+		m.release(room)
+	})
+}
+
+// leaveHeld removes every player still waiting for a reconnect from their
+// game, as their grace period would, and stops the timers. Called on
+// shutdown once every connection is gone.
+func (m *Manager) leaveHeld() {
+	m.mu.Lock()
+	rooms := make([]*Room, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	m.mu.Unlock()
+
+	for _, room := range rooms {
+		room.resume.Lock()
+		for playerID, h := range room.held {
+			if h.timer == nil {
+				continue
+			}
+			// A timer that already fired finds the player gone and does
+			// nothing.
+			h.timer.Stop()
+			delete(room.held, playerID)
+			room.Game.Leave(playerID)
+			h.conn.log.Info("shutting down, held player left")
+			m.release(room)
+		}
+		room.resume.Unlock()
+	}
+}
+
+// hold keeps room alive for a suspended player, like a connection does.
+// It is undone by release.
+func (m *Manager) hold(room *Room) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room.players++
+}
@@ -0,0 +1,399 @@
+package game
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/simplegameserver/gameserver/auth"
+	"github.com/simplegameserver/gameserver/chat"
+	"github.com/simplegameserver/gameserver/config"
+	"github.com/simplegameserver/gameserver/storage"
+)
+
+const (
+	// DefaultRoom is joined when the client does not ask for a room.
+	DefaultRoom = "default"
+
+	// emptyRoomTimeout is how long a room made by Create may stay empty
+	// before it is destroyed.
+	emptyRoomTimeout = time.Minute
+
+	shutdownReason = "server shutting down"
+)
+
+var (
+	roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+	errClosing = errors.New(shutdownReason)
+)
+
+// Room is one named instance of a game.
+type Room struct {
+	ID   string
+	Game Game
+
+	// Chat is the room's chat and Mutes the players muted in it.
+	Chat  *chat.Room
+	Mutes *chat.Mutes
+
+	log *slog.Logger
+
+	// lastTick is the UnixNano time the game loop last completed a tick,
+	// or the room was created.
+	lastTick atomic.Int64
+
+	// players and cancel are guarded by the owning Manager's mutex.
+	players int
+	cancel  context.CancelFunc
+	conns   map[*Conn]struct{}
+
+	// reserved, if not nil, are the only player IDs allowed to join as
+	// players; anyone else may only watch. Set by Create.
+	reserved map[string]bool
+
+	// held are the players of a Resumable game by ID, see Manager.join.
+	// resume guards it and is held while the game's Join, Resume, Suspend
+	// and Leave are called, so a reconnect cannot race the grace period.
+	resume sync.Mutex
+	held   map[string]*heldPlayer
+}
+
+// Manager creates, names and destroys the rooms of one game. A room lives
+// as long as at least one connection is using it.
+type Manager struct {
+	name    string
+	newGame Factory
+	conn    config.Conn
+	issuer  *auth.Issuer
+	gate    *Gate
+	log     *slog.Logger
+
+	// stallIntervals is the number of missed ticks after which a room's
+	// game loop is reported as stalled. Zero disables the check.
+	stallIntervals int
+	// rateLimit throttles the messages of every connection. The zero
+	// value disables it.
+	rateLimit config.RateLimit
+	// chat configures the chat of new rooms; chatFilters run after the
+	// configured filters.
+	chat        config.Chat
+	chatFilters []chat.Filter
+	// store is passed to the games of new rooms.
+	store storage.Storage
+
+	mu      sync.Mutex
+	rooms   map[string]*Room
+	closing bool
+
+	// inflight counts messages being handled, sessions the connections
+	// being served. Both are waited for on Shutdown.
+	inflight sync.WaitGroup
+	sessions sync.WaitGroup
+}
+
+// NewManager creates the rooms of one game. Connections are authenticated
+// with the session tokens of issuer and upgraded through gate.
+func NewManager(name string, newGame Factory, conn config.Conn, issuer *auth.Issuer, gate *Gate) *Manager {
+	return &Manager{
+		name:    name,
+		newGame: newGame,
+		conn:    conn,
+		issuer:  issuer,
+		gate:    gate,
+		log:     slog.With("game", name),
+		rooms:   make(map[string]*Room),
+	}
+}
+
+// Name is the name the game was registered under.
+func (m *Manager) Name() string {
+	return m.name
+}
+
+// Create makes a room with a fresh random ID and the given rule overrides.
+// If players are given, only they may join it as players. It is destroyed
+// if nobody joins it within emptyRoomTimeout.
+func (m *Manager) Create(overrides map[string]string, players ...string) (*Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := newRoomID()
+	for m.rooms[id] != nil {
+		id = newRoomID()
+	}
+	room, err := m.createLocked(id, overrides)
+	if err != nil {
+		return nil, err
+	}
+	if len(players) > 0 {
+		room.reserved = make(map[string]bool, len(players))
+		for _, p := range players {
+			room.reserved[p] = true
+		}
+	}
+	time.AfterFunc(emptyRoomTimeout, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if room.players == 0 && m.rooms[room.ID] == room {
+			m.destroyLocked(room)
+		}
+	})
+	return room, nil
+}
+
+// Get returns the room with the given ID if it exists.
+func (m *Manager) Get(id string) (*Room, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[id]
+	return room, ok
+}
+
+// Rooms returns the live rooms sorted by ID.
+func (m *Manager) Rooms() []*Room {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rooms := make([]*Room, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	return rooms
+}
+
+// ServeHTTP authenticates the session token in the "token" query parameter
+// and joins the connection to the room named by the "room" query
+// parameter, creating the room with the default rules on first use. Rooms
+// with other rules are made by Create, through the admin API.
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, ok := m.Authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	id := query.Get("room")
+	if id == "" {
+		id = DefaultRoom
+	}
+	if !roomIDPattern.MatchString(id) {
+		http.Error(w, "invalid room id", http.StatusBadRequest)
+		return
+	}
+
+	room, err := m.acquire(id)
+	if errors.Is(err, errClosing) {
+		http.Error(w, shutdownReason, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer m.release(room)
+
+	m.serve(room, session, w, r)
+}
+
+// Authenticate verifies the session token of a websocket handshake,
+// answering 401 if it is missing or invalid.
+func (m *Manager) Authenticate(w http.ResponseWriter, r *http.Request) (auth.Session, bool) {
+	session, err := m.issuer.FromRequest(r)
+	if err != nil {
+		m.log.Info("handshake rejected", "remote_addr", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return auth.Session{}, false
+	}
+	return session, true
+}
+
+// Shutdown stops every room's game loop, waits for the messages being
+// handled, then closes every connection with a close frame and waits for
+// the players to be removed from their games. Players held for a reconnect
+// leave at once, so their results are saved before Shutdown returns. It
+// returns early if ctx is done first.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closing = true
+	for _, room := range m.rooms {
+		room.cancel()
+	}
+	m.mu.Unlock()
+
+	if err := wait(ctx, &m.inflight); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	for _, room := range m.rooms {
+		for c := range room.conns {
+			c.CloseWithReason(websocket.CloseServiceRestart, shutdownReason)
+		}
+	}
+	m.mu.Unlock()
+
+	if err := wait(ctx, &m.sessions); err != nil {
+		return err
+	}
+	m.leaveHeld()
+	return nil
+}
+
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// beginMessage reports whether a message may still be handled. Each true
+// result must be matched by a call to m.inflight.Done.
+func (m *Manager) beginMessage() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closing {
+		return false
+	}
+	m.inflight.Add(1)
+	return true
+}
+
+func (m *Manager) track(room *Room, c *Conn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closing {
+		return false
+	}
+	room.conns[c] = struct{}{}
+	m.sessions.Add(1)
+	return true
+}
+
+func (m *Manager) untrack(room *Room, c *Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(room.conns, c)
+	m.sessions.Done()
+}
+
+func (m *Manager) acquire(id string) (*Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closing {
+		return nil, errClosing
+	}
+	room, ok := m.rooms[id]
+	if !ok {
+		var err error
+		if room, err = m.createLocked(id, nil); err != nil {
+			return nil, err
+		}
+	}
+	room.players++
+	return room, nil
+}
+
+func (m *Manager) release(room *Room) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room.players--
+	if room.players <= 0 && m.rooms[room.ID] == room {
+		m.destroyLocked(room)
+	}
+}
+
+func (m *Manager) createLocked(id string, overrides map[string]string) (*Room, error) {
+	if m.closing {
+		return nil, errClosing
+	}
+	logger := m.log.With("room", id)
+	mutes := chat.NewMutes()
+	filters := append([]chat.Filter{chat.DefaultFilter(m.chat, mutes)}, m.chatFilters...)
+	chatRoom := chat.NewRoom(m.chat.History, chat.Chain(filters...))
+	g, err := m.newGame(Env{Room: id, Logger: logger, Overrides: overrides, Chat: chatRoom, Storage: m.store})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	room := &Room{
+		ID:     id,
+		Game:   g,
+		Chat:   chatRoom,
+		Mutes:  mutes,
+		log:    logger,
+		cancel: cancel,
+		conns:  make(map[*Conn]struct{}),
+		held:   make(map[string]*heldPlayer),
+	}
+	room.lastTick.Store(time.Now().UnixNano())
+	m.rooms[id] = room
+	go m.run(ctx, room)
+
+	logger.Info("room created", "overrides", overrides)
+	return room, nil
+}
+
+// run calls Tick on the room's game every TickInterval until ctx is done.
+// It returns immediately for games that are purely event driven.
+func (m *Manager) run(ctx context.Context, room *Room) {
+	g := room.Game
+	interval := g.TickInterval()
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			g.Tick()
+			end := time.Now()
+			room.lastTick.Store(end.UnixNano())
+			tickDuration.Observe(end.Sub(start).Seconds(), m.name)
+		}
+	}
+}
+
+func (m *Manager) destroyLocked(room *Room) {
+	room.cancel()
+	delete(m.rooms, room.ID)
+	room.log.Info("room destroyed")
+}
+
+func newRoomID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
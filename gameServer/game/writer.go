@@ -0,0 +1,301 @@
+package game
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/simplegameserver/gameserver/config"
+	"github.com/simplegameserver/gameserver/protocol"
+)
+
+// Conn wraps a websocket connection with a single writer goroutine. Send
+// and SendState never block, so games may call them while holding their
+// own locks and a slow client can never stall a game loop.
+type Conn struct {
+	ws   *websocket.Conn
+	game string // name of the game, used as metrics label
+	cfg  config.Conn
+	log  *slog.Logger
+
+	send       chan []byte
+	stateReady chan struct{}
+	pong       chan string // ping payload to answer
+
+	mu    sync.Mutex
+	state []byte // latest state frame not yet written, nil if none
+
+	release func()       // called once the connection is closed, may be nil
+	caps    []string     // protocol capabilities agreed at handshake
+	role    string       // protocol.RolePlayer or RoleSpectator, set at handshake
+	wire    *meteredConn // nil unless upgraded by a Gate
+
+	closeOnce sync.Once
+	done      chan struct{}
+	closeCode int
+	closeText string
+	flush     bool
+}
+
+// newConn starts the write pump for ws. The pump also sends the periodic
+// pings and answers the client's, so nothing else may write to ws
+// afterwards. At most
+// cfg.SendQueueSize messages wait to be written; a client that lets the
+// queue fill up is disconnected. release is called once the connection is
+// closed.
+func newConn(ws *websocket.Conn, game string, cfg config.Conn, logger *slog.Logger, release func()) *Conn {
+	c := &Conn{
+		release:    release,
+		ws:         ws,
+		game:       game,
+		cfg:        cfg,
+		log:        logger,
+		send:       make(chan []byte, cfg.SendQueueSize),
+		stateReady: make(chan struct{}, 1),
+		pong:       make(chan string, 1),
+		done:       make(chan struct{}),
+	}
+	c.wire, _ = ws.NetConn().(*meteredConn)
+	// The default handler writes the pong from the read goroutine, where it
+	// would race the pump and count towards the next message's ratio.
+	ws.SetPingHandler(func(data string) error {
+		select {
+		case c.pong <- data:
+		default: // a pong is already waiting, it answers this ping too
+		}
+		return nil
+	})
+	go c.writePump()
+	return c
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+// Has reports whether the client agreed to use a protocol capability, such
+// as protocol.CapBinary, during the handshake.
+func (c *Conn) Has(capability string) bool {
+	return slices.Contains(c.caps, capability)
+}
+
+// Spectator reports whether the client joined as a spectator. Games must
+// not let spectators act or count them as players.
+func (c *Conn) Spectator() bool {
+	return c.role == protocol.RoleSpectator
+}
+
+// Done is closed once the connection starts shutting down.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Send queues msg for the client. If the queue is full the client is too
+// slow to keep up and is disconnected.
+func (c *Conn) Send(msg []byte) {
+	select {
+	case <-c.done:
+	case c.send <- msg:
+	default:
+		c.log.Warn("send queue full, dropping connection")
+		c.drop(websocket.CloseTryAgainLater, "slow_consumer")
+	}
+}
+
+// SendJSON marshals v and queues it with Send.
+func (c *Conn) SendJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Send(data)
+	return nil
+}
+
+// SendState queues a full state frame, written as a binary frame if it is
+// a binary message (see protocol.IsBinary). A state frame that has not been
+// written yet is replaced, so slow clients skip stale states instead of
+// queueing them. Frames that only make sense after the previous one, such
+// as deltas, must check StatePending first.
+func (c *Conn) SendState(msg []byte) {
+	c.mu.Lock()
+	c.state = msg
+	c.mu.Unlock()
+
+	select {
+	case c.stateReady <- struct{}{}:
+	default:
+	}
+}
+
+// StatePending reports whether a state frame is still waiting to be
+// written, so the next SendState would replace it.
+func (c *Conn) StatePending() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state != nil
+}
+
+// Close stops the write pump without flushing and closes the connection.
+func (c *Conn) Close() {
+	c.closeWith(websocket.CloseNormalClosure, "", false)
+}
+
+// CloseWithReason writes every queued message, then a close frame with
+// code and reason, and closes the connection.
+func (c *Conn) CloseWithReason(code int, reason string) {
+	c.closeWith(code, reason, true)
+}
+
+// Kick writes every queued message and closes the connection with a policy
+// violation close frame, telling the client it was removed by an admin.
+func (c *Conn) Kick() {
+	c.Disconnect("kicked")
+}
+
+// Disconnect writes every queued message, such as an error frame, and
+// closes the connection with a policy violation close frame carrying
+// reason. Games use it for clients that break the protocol.
+func (c *Conn) Disconnect(reason string) {
+	c.closeWith(websocket.ClosePolicyViolation, reason, true)
+}
+
+// lost reports whether the connection ended without anyone meaning to end
+// it: the network failed or the client went away without a normal close
+// frame, as a reloading browser does. readErr is the error that ended the
+// read loop, nil if the server stopped reading.
+func (c *Conn) lost(readErr error) bool {
+	select {
+	case <-c.done:
+		// Kicks, protocol violations and shutdown close on purpose; drop
+		// closes after a write error.
+		return c.closeCode == websocket.CloseAbnormalClosure || c.closeCode == websocket.CloseTryAgainLater
+	default:
+		return readErr != nil && !websocket.IsCloseError(readErr, websocket.CloseNormalClosure)
+	}
+}
+
+// drop closes the connection because of an error and counts it under
+// reason.
+func (c *Conn) drop(code int, reason string) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	droppedConnections.Inc(c.game, reason)
+	c.closeWith(code, reason, false)
+}
+
+func (c *Conn) closeWith(code int, reason string, flush bool) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeText = reason
+		c.flush = flush
+		close(c.done)
+	})
+}
+
+func (c *Conn) writePump() {
+	ticker := time.NewTicker(c.cfg.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.ws.Close()
+		if c.release != nil {
+			c.release()
+		}
+	}()
+
+	for {
+		select {
+		case <-c.done:
+			c.shutdown()
+			return
+		case msg := <-c.send:
+			if !c.write(msg) {
+				return
+			}
+		case <-c.stateReady:
+			c.mu.Lock()
+			msg := c.state
+			c.state = nil
+			c.mu.Unlock()
+			if msg != nil && !c.write(msg) {
+				return
+			}
+		case data := <-c.pong:
+			if err := c.ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(c.cfg.WriteTimeout)); err != nil {
+				c.log.Info("pong failed", "err", err)
+				c.drop(websocket.CloseAbnormalClosure, "write_failed")
+				return
+			}
+		case <-ticker.C:
+			if err := c.ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(c.cfg.WriteTimeout)); err != nil {
+				c.log.Info("ping failed", "err", err)
+				c.drop(websocket.CloseAbnormalClosure, "ping_failed")
+				return
+			}
+		}
+	}
+}
+
+func (c *Conn) write(msg []byte) bool {
+	c.ws.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+	frameType := websocket.TextMessage
+	if protocol.IsBinary(msg) {
+		frameType = websocket.BinaryMessage
+	}
+	// Small messages do not shrink enough to be worth deflating.
+	compress := c.wire != nil && c.wire.deflate && len(msg) >= c.cfg.CompressionThreshold
+	c.ws.EnableWriteCompression(compress)
+	var written int64
+	if c.wire != nil {
+		written = c.wire.written.Load()
+	}
+	if err := c.ws.WriteMessage(frameType, msg); err != nil {
+		c.log.Info("write failed", "err", err)
+		c.drop(websocket.CloseAbnormalClosure, "write_failed")
+		return false
+	}
+	outboundBytes.Add(float64(len(msg)), c.game)
+	if c.wire != nil {
+		written = c.wire.written.Load() - written
+		outboundWireBytes.Add(float64(written), c.game)
+		if compress && written > 0 {
+			compressionRatio.Observe(float64(len(msg))/float64(written), c.game)
+		}
+	}
+	return true
+}
+
+// shutdown runs on the pump goroutine once done is closed.
+func (c *Conn) shutdown() {
+	if !c.flush {
+		return
+	}
+	for {
+		select {
+		case msg := <-c.send:
+			if !c.write(msg) {
+				return
+			}
+			continue
+		default:
+		}
+		break
+	}
+	c.mu.Lock()
+	msg := c.state
+	c.mu.Unlock()
+	if msg != nil && !c.write(msg) {
+		return
+	}
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(c.closeCode, c.closeText),
+		time.Now().Add(c.cfg.WriteTimeout))
+}
@@ -2,4 +2,4 @@ module github.com/simplegameserver/gameserver
 
 go 1.23.0
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require github.com/gorilla/websocket v1.5.3
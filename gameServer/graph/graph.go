@@ -3,20 +3,28 @@ package graph
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
 	"math"
-	"net/http"
+	"slices"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/simplegameserver/gameserver/auth"
+	"github.com/simplegameserver/gameserver/chat"
+	"github.com/simplegameserver/gameserver/config"
+	"github.com/simplegameserver/gameserver/game"
+	"github.com/simplegameserver/gameserver/protocol"
+	"github.com/simplegameserver/gameserver/storage"
 )
 
 type Player struct {
-	ID    string          `json:"id"`
-	Name  string          `json:"name"`
-	Score int             `json:"score"`
-	Conn  *websocket.Conn `json:"-"`
+	ID    string     `json:"id"`
+	Name  string     `json:"name"`
+	Score int        `json:"score"`
+	Conn  *game.Conn `json:"-"`
+
+	joined time.Time
 }
 
 type Position struct {
@@ -47,9 +55,10 @@ type GraphMessage struct {
 	Points     []Position `json:"points"`
 }
 
+// InitMessage is the first message of a connection. The player ID and
+// name come from the session token, not from the client.
 type InitMessage struct {
-	Type   string `json:"type"`
-	Player Player `json:"player"`
+	Type string `json:"type"`
 }
 
 type PlayerJoinedOrLeaveMessages struct {
@@ -58,200 +67,320 @@ type PlayerJoinedOrLeaveMessages struct {
 	TotalPlayer int      `json:"totalPlayer"`
 }
 
-var (
-	players             = make(map[string]*Player)
+// Game is one graph match. Create it with New.
+type Game struct {
+	rules  config.Graph
+	log    *slog.Logger
+	router *protocol.Router
+	chat   *chat.Room
+	room   string
+	store  storage.Storage
+
+	mu                  sync.Mutex
+	players             map[string]*Player
+	spectators          map[string]*Player // watching, no score or monsters
 	monsters            []Monster
-	joinOrLeaveMessages = PlayerJoinedOrLeaveMessages{
-		Type:        "playerJoinedOrLeave",
-		Message:     []string{},
-		TotalPlayer: 0,
+	joinOrLeaveMessages PlayerJoinedOrLeaveMessages
+}
+
+// Factory creates matches with the given rules, overridden per room.
+func Factory(rules config.Graph) game.Factory {
+	return func(env game.Env) (game.Game, error) {
+		// Each room gets its own copy, overrides must not leak to later rooms.
+		rules := rules
+		if err := config.Override(&rules, env.Overrides); err != nil {
+			return nil, err
+		}
+		return New(rules, env), nil
 	}
-	mu       sync.Mutex
-	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
+}
+
+// New creates the match of room env.Room.
+func New(rules config.Graph, env game.Env) *Game {
+	g := &Game{
+		rules:      rules,
+		log:        env.Logger,
+		router:     protocol.NewRouter(),
+		chat:       env.Chat,
+		room:       env.Room,
+		store:      env.Storage,
+		players:    make(map[string]*Player),
+		spectators: make(map[string]*Player),
+		joinOrLeaveMessages: PlayerJoinedOrLeaveMessages{
+			Type:        "playerJoinedOrLeave",
+			Message:     []string{},
+			TotalPlayer: 0,
 		},
 	}
-)
+	protocol.Handle(g.router, "addMonster", g.handleAddMonster)
+	protocol.Handle(g.router, "graph", g.handleGraph)
+	protocol.Handle(g.router, "chat", g.handleChat)
+	return g
+}
 
-func initPlayer(player Player) *Player {
+func initPlayer(session auth.Session) *Player {
 	return &Player{
-		ID:    player.ID,
-		Name:  player.Name,
-		Score: 0,
+		ID:     session.PlayerID,
+		Name:   session.Name,
+		Score:  0,
+		joined: time.Now(),
 	}
 }
 
-func HandleConnection(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("WebSocket error:", err)
-		return
-	}
-
-	conn.SetReadLimit(512)
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
-	})
-
+func (g *Game) Join(conn *game.Conn, session auth.Session, init []byte) error {
 	var initMsg InitMessage
-	err = conn.ReadJSON(&initMsg)
-	if err != nil || initMsg.Type != "init" {
-		log.Println("Failed to read init message:", err)
-		conn.Close()
-		return
+	if err := json.Unmarshal(init, &initMsg); err != nil || initMsg.Type != "init" {
+		return protocol.ErrInvalidInit
 	}
 
-	playerID := initMsg.Player.ID
-
-	mu.Lock()
-	players[playerID] = initPlayer(initMsg.Player)
-	players[playerID].Conn = conn
-	mu.Unlock()
+	playerID := session.PlayerID
 
-	notifyPlayerJoinedAndLeave(playerID, "join")
-	log.Println("Joined player with id:", playerID)
+	g.mu.Lock()
+	_, playing := g.players[playerID]
+	_, watching := g.spectators[playerID]
+	if playing || watching {
+		g.mu.Unlock()
+		return protocol.ErrDuplicateSession
+	}
+	if conn.Spectator() {
+		g.spectators[playerID] = initPlayer(session)
+		g.spectators[playerID].Conn = conn
+		conn.SendJSON(g.joinOrLeaveMessages)
+		conn.SendJSON(g.chat.History())
+		g.broadcastGameState()
+		g.mu.Unlock()
+		g.log.Info("spectator joined", "player_id", playerID)
+		return nil
+	}
+	g.players[playerID] = initPlayer(session)
+	g.players[playerID].Conn = conn
+	conn.SendJSON(g.chat.History())
+	g.mu.Unlock()
+
+	g.notifyPlayerJoinedAndLeave(playerID, "join")
+	g.log.Info("player joined", "player_id", playerID)
+	return nil
+}
 
-	go pingPlayer(playerID, conn)
+func (g *Game) HandleMessage(playerID string, data []byte) error {
+	g.mu.Lock()
+	_, watching := g.spectators[playerID]
+	g.mu.Unlock()
+	if msgType, _ := protocol.TypeOf(data); watching && msgType != "chat" {
+		return protocol.ErrSpectator
+	}
+	return g.router.Dispatch(playerID, data)
+}
 
-	for {
-		var msg interface{}
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("Read error for player %s: %v", playerID, err)
-			handlePlayerDisconnect(playerID)
-			break
-		}
+func (g *Game) handleAddMonster(playerID string, msg AddMonsterMessage) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Monsters score for whoever added them, never for the player named by
+	// the client.
+	msg.Monster.OfPlayer = playerID
+	g.monsters = append(g.monsters, msg.Monster)
+	g.broadcastGameState()
+	return nil
+}
 
-		data, _ := json.Marshal(msg)
-		var msgType struct {
-			Type string `json:"type"`
-		}
-		json.Unmarshal(data, &msgType)
-
-		if msgType.Type == "addMonster" {
-			var addMsg AddMonsterMessage
-			json.Unmarshal(data, &addMsg)
-			mu.Lock()
-			monsters = append(monsters, addMsg.Monster)
-			broadcastGameState()
-			mu.Unlock()
-		} else if msgType.Type == "graph" {
-			var graphMsg GraphMessage
-			json.Unmarshal(data, &graphMsg)
-			mu.Lock()
-			processGraph(playerID, graphMsg.Points)
-			broadcastGameState()
-			mu.Unlock()
-		}
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	}
+func (g *Game) handleGraph(playerID string, msg GraphMessage) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.processGraph(playerID, msg.Points)
+	g.broadcastGameState()
+	return nil
 }
 
-func pingPlayer(playerID string, conn *websocket.Conn) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+// handleChat posts a chat message of a player or spectator and broadcasts
+// it to the match.
+func (g *Game) handleChat(playerID string, msg chat.SendMessage) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-	for range ticker.C {
-		if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second)); err != nil {
-			log.Printf("Ping failed for player %s: %v", playerID, err)
-			handlePlayerDisconnect(playerID)
-			return
-		}
+	sender, exists := g.players[playerID]
+	if !exists {
+		sender, exists = g.spectators[playerID]
+	}
+	if !exists {
+		return nil
+	}
+	posted, err := g.chat.Post(playerID, sender.Name, msg.Text)
+	if err != nil {
+		return err
+	}
+	messageJSON, err := json.Marshal(posted)
+	if err != nil {
+		return err
 	}
+	g.broadcastMessage(messageJSON)
+	return nil
 }
 
-func handlePlayerDisconnect(playerID string) {
-	mu.Lock()
-	if player, exists := players[playerID]; exists {
+func (g *Game) Leave(playerID string) {
+	g.mu.Lock()
+	if s, exists := g.spectators[playerID]; exists {
+		s.Conn.Close()
+		delete(g.spectators, playerID)
+		g.mu.Unlock()
+		g.log.Info("spectator left", "player_id", playerID)
+		return
+	}
+	if player, exists := g.players[playerID]; exists {
 		player.Conn.Close()
-		delete(players, playerID)
+		g.recordSession(player)
+		delete(g.players, playerID)
 		// Remove monsters associated with this player
 		newMonsters := []Monster{}
-		for _, m := range monsters {
+		for _, m := range g.monsters {
 			if m.OfPlayer != playerID {
 				newMonsters = append(newMonsters, m)
 			}
 		}
-		monsters = newMonsters
-		mu.Unlock()
-		notifyPlayerJoinedAndLeave(playerID, "leave")
-		log.Printf("Player %s disconnected", playerID)
+		g.monsters = newMonsters
+		g.mu.Unlock()
+		g.notifyPlayerJoinedAndLeave(playerID, "leave")
+		g.log.Info("player left", "player_id", playerID)
 	} else {
-		mu.Unlock()
+		g.mu.Unlock()
 	}
 }
 
-func notifyPlayerJoinedAndLeave(playerID string, joinOrLeave string) {
+// Players returns the IDs of the players in the match, sorted.
+func (g *Game) Players() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return slices.Sorted(maps.Keys(g.players))
+}
+
+// Kick closes the player's connection with a "kicked" close frame and
+// removes them and their monsters.
+func (g *Game) Kick(playerID string) bool {
+	g.mu.Lock()
+	var conn *game.Conn
+	if player, exists := g.players[playerID]; exists {
+		conn = player.Conn
+	} else if s, watching := g.spectators[playerID]; watching {
+		conn = s.Conn // spectators can be kicked too, e.g. for spamming chat
+	}
+	if conn != nil {
+		conn.Kick()
+	}
+	g.mu.Unlock()
+	if conn == nil {
+		return false
+	}
+	g.log.Info("player kicked", "player_id", playerID)
+	g.Leave(playerID)
+	return true
+}
+
+// Command runs an admin command. "clearMonsters" removes every monster.
+func (g *Game) Command(name string) error {
+	switch name {
+	case "clearMonsters":
+		g.mu.Lock()
+		g.log.Info("clearing monsters", "monsters", len(g.monsters))
+		g.monsters = nil
+		g.broadcastGameState()
+		g.mu.Unlock()
+		return nil
+	default:
+		return game.ErrUnknownCommand
+	}
+}
+
+func (g *Game) notifyPlayerJoinedAndLeave(playerID string, joinOrLeave string) {
 	joinOrLeaveMessage := fmt.Sprintf("%s %s the game", playerID, joinOrLeave)
-	mu.Lock()
-	joinOrLeaveMessages.Message = append(joinOrLeaveMessages.Message, joinOrLeaveMessage)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.joinOrLeaveMessages.Message = append(g.joinOrLeaveMessages.Message, joinOrLeaveMessage)
 	if joinOrLeave == "join" {
-		joinOrLeaveMessages.TotalPlayer++
+		g.joinOrLeaveMessages.TotalPlayer++
 	} else if joinOrLeave == "leave" {
-		joinOrLeaveMessages.TotalPlayer--
+		g.joinOrLeaveMessages.TotalPlayer--
 	}
 
-	messageJSON, err := json.Marshal(joinOrLeaveMessages)
+	messageJSON, err := json.Marshal(g.joinOrLeaveMessages)
 	if err != nil {
-		log.Println("JSON Marshal error:", err)
-		mu.Unlock()
+		g.log.Error("marshal join/leave notification", "err", err)
 		return
 	}
-	mu.Unlock()
 
-	broadcastMessage(messageJSON)
+	g.broadcastMessage(messageJSON)
 }
 
-func broadcastMessage(message []byte) {
-	mu.Lock()
-	for playerID, player := range players {
-		if err := player.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Printf("Failed to send message to player %s: %v", playerID, err)
-			go handlePlayerDisconnect(playerID)
-		}
+// recordSession saves the score of a player leaving the match. It must be
+// called with g.mu held.
+func (g *Game) recordSession(player *Player) {
+	session := storage.GraphSession{
+		Room:     g.room,
+		PlayerID: player.ID,
+		Name:     player.Name,
+		Score:    player.Score,
+		Joined:   player.joined,
+		Left:     time.Now(),
+	}
+	if err := g.store.SaveGraphSession(session); err != nil {
+		g.log.Error("save graph session", "player_id", player.ID, "err", err)
 	}
-	mu.Unlock()
 }
 
-func broadcastGameState() {
-	playerList := make([]Player, 0, len(players))
-	for _, p := range players {
-		playerList = append(playerList, Player{ID: p.ID, Name: p.Name, Score: p.Score})
+// broadcastMessage must be called with g.mu held.
+func (g *Game) broadcastMessage(message []byte) {
+	for _, player := range g.players {
+		player.Conn.Send(message)
 	}
-
-	gameState := GameState{
-		Type:     "gameState",
-		Monsters: monsters,
-		Players:  playerList,
+	for _, s := range g.spectators {
+		s.Conn.Send(message)
 	}
-	stateJSON, err := json.Marshal(gameState)
+}
+
+// broadcastGameState must be called with g.mu held.
+func (g *Game) broadcastGameState() {
+	stateJSON, err := json.Marshal(g.state())
 	if err != nil {
-		log.Println("JSON Marshal error:", err)
+		g.log.Error("marshal game state", "err", err)
 		return
 	}
 
-	broadcastMessage(stateJSON)
+	for _, player := range g.players {
+		player.Conn.SendState(stateJSON)
+	}
+	for _, s := range g.spectators {
+		s.Conn.SendState(stateJSON)
+	}
 }
 
-func processGraph(playerID string, points []Position) {
-	const HIT_DISTANCE = 0.5 // Distance threshold for monster hit
+func (g *Game) state() GameState {
+	playerList := make([]Player, 0, len(g.players))
+	for _, p := range g.players {
+		playerList = append(playerList, Player{ID: p.ID, Name: p.Name, Score: p.Score})
+	}
+
+	return GameState{
+		Type:     "gameState",
+		Monsters: append([]Monster(nil), g.monsters...),
+		Players:  playerList,
+	}
+}
+
+func (g *Game) processGraph(playerID string, points []Position) {
 	newMonsters := []Monster{}
-	for _, m := range monsters {
+	for _, m := range g.monsters {
 		hit := false
 		for _, p := range points {
 			distance := math.Sqrt(math.Pow(p.X-m.X, 2) + math.Pow(p.Y-m.Y, 2))
-			if distance < HIT_DISTANCE {
+			if distance < g.rules.HitDistance { // Distance threshold for monster hit
 				hit = true
+				monstersHit.Inc()
 				// Award points to the player who plotted the graph
-				if player, exists := players[playerID]; exists {
+				if player, exists := g.players[playerID]; exists {
 					player.Score++
 				}
 				// Award points to the monster's owner if different
 				if m.OfPlayer != playerID {
-					if owner, exists := players[m.OfPlayer]; exists {
+					if owner, exists := g.players[m.OfPlayer]; exists {
 						owner.Score++
 					}
 				}
@@ -262,9 +391,17 @@ func processGraph(playerID string, points []Position) {
 			newMonsters = append(newMonsters, m)
 		}
 	}
-	monsters = newMonsters
+	g.monsters = newMonsters
 }
 
-func GameLoop() {
-	// Placeholder for future real-time updates if needed
+func (g *Game) Snapshot() any {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.state()
 }
+
+// Graph has no real-time updates yet, every change is driven by a message.
+func (g *Game) TickInterval() time.Duration { return 0 }
+
+func (g *Game) Tick() {}
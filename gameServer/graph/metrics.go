@@ -0,0 +1,6 @@
+package graph
+
+import "github.com/simplegameserver/gameserver/metrics"
+
+var monstersHit = metrics.NewCounter("gameserver_graph_monsters_hit_total",
+	"Monsters hit by a plotted graph.")
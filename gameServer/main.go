@@ -1,22 +1,124 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/simplegameserver/gameserver/admin"
+	"github.com/simplegameserver/gameserver/auth"
 	"github.com/simplegameserver/gameserver/caro"
+	"github.com/simplegameserver/gameserver/config"
+	"github.com/simplegameserver/gameserver/game"
 	"github.com/simplegameserver/gameserver/graph"
+	"github.com/simplegameserver/gameserver/metrics"
 	"github.com/simplegameserver/gameserver/snake"
+	"github.com/simplegameserver/gameserver/storage"
 )
 
 func main() {
-	http.HandleFunc("/snake", snake.HandleConnection)
-	http.HandleFunc("/graph", graph.HandleConnection)
-	http.HandleFunc("/caro", caro.HandleConnection)
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(newLogger(cfg.Log))
 
-	go snake.GameLoop()
-	go graph.GameLoop()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	log.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	sessions, err := auth.NewIssuer(cfg.Auth)
+	if err != nil {
+		slog.Error("create session issuer", "err", err)
+		os.Exit(1)
+	}
+	if cfg.Auth.Secret == "" {
+		slog.Warn("auth.secret not set, session tokens will not survive a restart")
+	}
+
+	store, err := storage.Open(cfg.Storage)
+	if err != nil {
+		slog.Error("open storage", "err", err)
+		os.Exit(1)
+	}
+	if cfg.Storage.Path == "" {
+		slog.Warn("storage.path not set, player profiles and results will not survive a restart")
+	}
+
+	scores, err := snake.NewLeaderboard(store, cfg.Leaderboard.Size)
+	if err != nil {
+		slog.Error("load snake leaderboard", "err", err)
+		os.Exit(1)
+	}
+
+	games := game.NewRegistry(cfg, sessions, store)
+	games.Register("snake", snake.Factory(cfg.Snake, cfg.RateLimit, scores))
+	games.Register("graph", graph.Factory(cfg.Graph))
+	caroRooms := games.Register("caro", caro.Factory(cfg.Caro))
+	matchmaker := caro.NewMatchmaker(caroRooms)
+
+	mux := http.NewServeMux()
+	for _, m := range games.Managers() {
+		mux.Handle("/"+m.Name(), m)
+	}
+	mux.Handle("/login", game.CORS(cfg.Handshake, sessions.LoginHandler(store)))
+	mux.Handle("/caro/queue", matchmaker)
+	mux.Handle("GET /snake/leaderboard", game.CORS(cfg.Handshake, scores))
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", games.Healthz)
+	mux.HandleFunc("/readyz", games.Readyz)
+	if cfg.Admin.Token != "" {
+		mux.Handle("/admin/", admin.New(games, store, cfg.Admin.Token))
+	} else {
+		slog.Info("admin API disabled, set admin.token to enable it")
+	}
+
+	srv := &http.Server{Addr: cfg.Server.Addr, Handler: mux}
+	go func() {
+		slog.Info("server starting", "addr", cfg.Server.Addr)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	// Websocket connections are hijacked, so srv.Shutdown only stops new
+	// requests; the games close their own connections.
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("http shutdown", "err", err)
+	}
+	matchmaker.Shutdown()
+	if err := games.Shutdown(shutdownCtx); err != nil {
+		slog.Error("game shutdown", "err", err)
+	}
+	// Every player, held for a reconnect or not, has left and had their
+	// results saved by now.
+	if err := store.Close(); err != nil {
+		slog.Error("close storage", "err", err)
+	}
+	slog.Info("server stopped")
+}
+
+// newLogger builds the process logger. cfg has already been validated.
+func newLogger(cfg config.Log) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.Level))
+
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
 }
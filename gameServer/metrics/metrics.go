@@ -0,0 +1,275 @@
+// Package metrics is a small collector of counters, gauges and histograms
+// exposed in the Prometheus text format. Metrics are registered in Default
+// when created, usually as package-level variables next to the code that
+// updates them.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the registry served by Handler.
+var Default = &Registry{}
+
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds metrics in registration order.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.collectors {
+		if existing.name() == c.name() {
+			panic(fmt.Sprintf("metrics: %q registered twice", c.name()))
+		}
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes every metric in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the Default registry.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.Write(w)
+	})
+}
+
+// vec stores one value per combination of label values.
+type vec[T any] struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+	newValue   func() T
+
+	mu     sync.Mutex
+	series map[string]*T
+}
+
+func newVec[T any](name, help, kind string, labels []string, newValue func() T) *vec[T] {
+	v := &vec[T]{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		newValue:   newValue,
+		series:     make(map[string]*T),
+	}
+	if len(labels) == 0 {
+		// A metric without labels has exactly one series; expose it from the start.
+		v.with(nil, func(*T) {})
+	}
+	return v
+}
+
+func (v *vec[T]) name() string { return v.metricName }
+
+// with calls fn with the value for labelValues, creating it if needed.
+func (v *vec[T]) with(labelValues []string, fn func(*T)) {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.metricName, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		value := v.newValue()
+		s = &value
+		v.series[key] = s
+	}
+	fn(s)
+}
+
+// Delete drops the series for labelValues, e.g. when a room is destroyed.
+func (v *vec[T]) Delete(labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.series, strings.Join(labelValues, "\xff"))
+}
+
+func (v *vec[T]) write(w io.Writer, sample func(w io.Writer, labels string, value *T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.metricName, v.help, v.metricName, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var values []string
+		if len(v.labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+		sample(w, formatLabels(v.labels, values), v.series[k])
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(values[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	*vec[float64]
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels, func() float64 { return 0 })}
+	Default.register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.with(labelValues, func(v *float64) { *v += delta })
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.vec.write(w, func(w io.Writer, labels string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, braces(labels), formatFloat(*v))
+	})
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	*vec[float64]
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels, func() float64 { return 0 })}
+	Default.register(g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.with(labelValues, func(v *float64) { *v = value })
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.with(labelValues, func(v *float64) { *v += delta })
+}
+
+func (g *Gauge) Inc(labelValues ...string) { g.Add(1, labelValues...) }
+
+func (g *Gauge) Dec(labelValues ...string) { g.Add(-1, labelValues...) }
+
+func (g *Gauge) write(w io.Writer) {
+	g.vec.write(w, func(w io.Writer, labels string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, braces(labels), formatFloat(*v))
+	})
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	*vec[histogramValue]
+	buckets []float64
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// DurationBuckets suits durations in seconds from 100µs to 1s.
+var DurationBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		vec: newVec(name, help, "histogram", labels, func() histogramValue {
+			return histogramValue{counts: make([]uint64, len(buckets))}
+		}),
+		buckets: buckets,
+	}
+	Default.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.with(labelValues, func(v *histogramValue) {
+		if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+			v.counts[i]++
+		}
+		v.sum += value
+		v.count++
+	})
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.vec.write(w, func(w io.Writer, labels string, v *histogramValue) {
+		sep := ""
+		if labels != "" {
+			sep = ","
+		}
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += v.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", h.metricName, labels, sep, formatFloat(upper), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", h.metricName, labels, sep, v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, braces(labels), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, braces(labels), v.count)
+	})
+}
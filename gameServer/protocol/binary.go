@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Binary messages are sent instead of JSON to clients that agreed to
+// CapBinary. They start with a kind byte below 0x09, which no JSON text can
+// start with, so both encodings can share a connection: Conn writes them as
+// binary frames and Router dispatches them to the decoder of their kind.
+const maxBinaryKind = 0x08
+
+// IsBinary reports whether data is a binary message.
+func IsBinary(data []byte) bool {
+	return len(data) > 0 && data[0] <= maxBinaryKind
+}
+
+// ErrBinaryNotAgreed rejects binary frames from clients that did not
+// negotiate CapBinary.
+var ErrBinaryNotAgreed = NewError(CodeMalformedMessage, "binary frames were not negotiated")
+
+// HandleBinary registers decode for binary messages of kind. The decoded
+// message is passed to the handler registered with Handle for msgType, which
+// must take an M. It panics if kind is taken, out of range or the handler
+// does not match.
+func HandleBinary[M any](r *Router, kind byte, msgType string, decode func(data []byte) (M, error)) {
+	if kind == 0 || kind > maxBinaryKind {
+		panic(fmt.Sprintf("protocol: binary kind 0x%02x out of range", kind))
+	}
+	if _, dup := r.binary[kind]; dup {
+		panic(fmt.Sprintf("protocol: binary kind 0x%02x registered twice", kind))
+	}
+	fn, ok := r.typed[msgType].(func(string, M) error)
+	if !ok {
+		panic(fmt.Sprintf("protocol: no %T handler for %q", fn, msgType))
+	}
+	r.binary[kind] = func(playerID string, data []byte) error {
+		msg, err := decode(data)
+		if err != nil {
+			return &DecodeError{Type: msgType, Err: ErrMalformed}
+		}
+		return fn(playerID, msg)
+	}
+}
+
+// AppendUvarint and the helpers below build binary messages; Reader reads
+// them back.
+
+func AppendString(b []byte, s string) []byte {
+	b = AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func AppendUvarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// AppendVarint appends v zigzag encoded, so small negative numbers stay
+// small.
+func AppendVarint(b []byte, v int64) []byte {
+	return AppendUvarint(b, uint64(v<<1)^uint64(v>>63))
+}
+
+// Reader decodes a binary message. The first error sticks: once reading
+// fails every method returns zero values and Err reports it.
+type Reader struct {
+	data []byte
+	err  error
+}
+
+func NewReader(data []byte) *Reader {
+	return &Reader{data: data}
+}
+
+func (r *Reader) Err() error {
+	if r.err == nil && len(r.data) > 0 {
+		return fmt.Errorf("%d trailing bytes", len(r.data))
+	}
+	return r.err
+}
+
+// Len returns the number of bytes not read yet, zero once reading failed.
+func (r *Reader) Len() int {
+	if r.err != nil {
+		return 0
+	}
+	return len(r.data)
+}
+
+// Count reads the length of a list whose items take at least one byte
+// each. A count the rest of the message cannot hold fails.
+func (r *Reader) Count() int {
+	n := r.Uvarint()
+	if r.err == nil && n > uint64(len(r.data)) {
+		r.err = fmt.Errorf("count of %d exceeds message", n)
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (r *Reader) Byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) == 0 {
+		r.err = fmt.Errorf("unexpected end of message")
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *Reader) Uvarint() uint64 {
+	var v uint64
+	for shift := 0; shift < 64; shift += 7 {
+		b := r.Byte()
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v
+		}
+	}
+	if r.err == nil {
+		r.err = fmt.Errorf("varint overflows 64 bits")
+	}
+	return 0
+}
+
+func (r *Reader) Varint() int64 {
+	u := r.Uvarint()
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (r *Reader) String() string {
+	n := r.Uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(len(r.data)) {
+		r.err = fmt.Errorf("string of %d bytes exceeds message", n)
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	if !utf8.ValidString(s) {
+		r.err = fmt.Errorf("string is not valid UTF-8")
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package protocol
+
+import "errors"
+
+// Code identifies the reason of an error frame. Codes are part of the
+// protocol: clients switch on them, so existing ones must never change.
+type Code string
+
+const (
+	CodeMalformedMessage   Code = "MALFORMED_MESSAGE"
+	CodeUnknownType        Code = "UNKNOWN_MESSAGE_TYPE"
+	CodeInvalidInit        Code = "INVALID_INIT"
+	CodeUnsupportedVersion Code = "UNSUPPORTED_VERSION"
+	CodeDuplicateSession   Code = "DUPLICATE_SESSION"
+	CodeRateLimited        Code = "RATE_LIMITED"
+	CodeSpectator          Code = "SPECTATOR"
+	CodeRoomReserved       Code = "ROOM_RESERVED"
+	CodeRoomFull           Code = "ROOM_FULL"
+	CodeInternal           Code = "INTERNAL_ERROR"
+
+	// Caro
+	CodeGameNotActive Code = "GAME_NOT_ACTIVE"
+	CodeNotYourTurn   Code = "NOT_YOUR_TURN"
+	CodeGameOver      Code = "GAME_OVER"
+	CodeOutOfBounds   Code = "OUT_OF_BOUNDS"
+	CodeCellTaken     Code = "CELL_TAKEN"
+
+	// Snake
+	CodeInvalidDirection Code = "INVALID_DIRECTION"
+
+	// Chat
+	CodeChatRejected Code = "CHAT_REJECTED"
+	CodeMuted        Code = "MUTED"
+)
+
+var (
+	ErrInvalidInit      = NewError(CodeInvalidInit, "invalid init message")
+	ErrDuplicateSession = NewError(CodeDuplicateSession, "player already connected")
+	ErrRateLimited      = NewError(CodeRateLimited, "rate limited")
+	ErrSpectator        = NewError(CodeSpectator, "spectators cannot play")
+	ErrRoomReserved     = NewError(CodeRoomReserved, "room is reserved for other players")
+)
+
+// Error is an error reported to the client with a stable code.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func NewError(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorMessage is the error frame sent to a client whose message or
+// handshake was rejected.
+type ErrorMessage struct {
+	Type    string `json:"type"` // Always "error"
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+// ErrorFrame returns the error frame for err. Errors that do not wrap an
+// *Error are reported as INTERNAL_ERROR.
+func ErrorFrame(err error) ErrorMessage {
+	code := CodeInternal
+	var pe *Error
+	if errors.As(err, &pe) {
+		code = pe.Code
+	}
+	return ErrorMessage{Type: "error", Code: code, Message: err.Error()}
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// Version is the protocol version spoken by this server. Bump it, and
+// MinVersion when older clients can no longer be served, on every
+// incompatible change.
+const (
+	Version    = 1
+	MinVersion = 1
+)
+
+// Capabilities a client may ask for in its init message. The server
+// agrees to those the game supports.
+const (
+	CapBinary      = "binary"      // compact binary frames instead of JSON
+	CapCompression = "compression" // permessage-deflate
+	CapDelta       = "delta"       // delta state updates between keyframes
+)
+
+// Roles a client may join a game with. Spectators receive what players do
+// but cannot act and are not counted as players.
+const (
+	RolePlayer    = "player"
+	RoleSpectator = "spectator"
+)
+
+// Init holds the fields of the init message shared by every game. Games
+// decode their own fields from the same message.
+type Init struct {
+	Type         string   `json:"type"` // Always "init"
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	Role         string   `json:"role"` // RolePlayer if empty
+}
+
+// InitAck answers an accepted init message with what was agreed.
+type InitAck struct {
+	Type         string   `json:"type"` // Always "initAck"
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	Role         string   `json:"role"`
+	PlayerID     string   `json:"playerId"`
+}
+
+// Negotiate checks the version of an init message and returns the
+// capabilities both the client and the server support, in the client's
+// order. Clients sending no version are older than versioning and are
+// rejected like any other unsupported version.
+func Negotiate(data []byte, supported []string) (Init, []string, error) {
+	var init Init
+	if err := json.Unmarshal(data, &init); err != nil || init.Type != "init" {
+		return init, nil, ErrInvalidInit
+	}
+	if init.Version < MinVersion || init.Version > Version {
+		return init, nil, NewError(CodeUnsupportedVersion, fmt.Sprintf(
+			"protocol version %d is not supported (server speaks %d to %d), please reload the page to upgrade the client",
+			init.Version, MinVersion, Version))
+	}
+	switch init.Role {
+	case "":
+		init.Role = RolePlayer
+	case RolePlayer, RoleSpectator:
+	default:
+		return init, nil, NewError(CodeInvalidInit, fmt.Sprintf("unknown role %q", init.Role))
+	}
+
+	agreed := []string{}
+	for _, c := range init.Capabilities {
+		if slices.Contains(supported, c) && !slices.Contains(agreed, c) {
+			agreed = append(agreed, c)
+		}
+	}
+	return init, agreed, nil
+}
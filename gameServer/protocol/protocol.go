@@ -0,0 +1,86 @@
+// Package protocol holds the message envelope shared by every game and the
+// Router that dispatches client messages to typed handlers.
+//
+// Every client message is a JSON object with a "type" field. A game
+// registers one handler per type:
+//
+//	r := protocol.NewRouter()
+//	protocol.Handle(r, "move", g.handleMove) // func(playerID string, msg MoveMessage) error
+//
+// and calls r.Dispatch from Game.HandleMessage.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Envelope is the part of every message needed to route it.
+type Envelope struct {
+	Type string `json:"type"`
+}
+
+var (
+	ErrMalformed   = NewError(CodeMalformedMessage, "malformed message")
+	ErrUnknownType = NewError(CodeUnknownType, "unknown message type")
+)
+
+// DecodeError reports a message that is not valid JSON, has no type or
+// does not match the shape of its type. It wraps ErrMalformed or
+// ErrUnknownType.
+type DecodeError struct {
+	Type string // message type, "" if it could not be read
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Type == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %q", e.Err, e.Type)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// TypeOf returns the type of a message. All binary messages have type
+// "binary".
+func TypeOf(data []byte) (string, error) {
+	if IsBinary(data) {
+		return "binary", nil
+	}
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Type == "" {
+		return "", &DecodeError{Err: ErrMalformed}
+	}
+	return env.Type, nil
+}
+
+// Decode decodes a message of the given type into msg.
+func Decode(data []byte, msgType string, msg any) error {
+	if err := json.Unmarshal(data, msg); err != nil {
+		return &DecodeError{Type: msgType, Err: ErrMalformed}
+	}
+	return nil
+}
+
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string { return e.err.Error() }
+func (e *fatalError) Unwrap() error { return e.err }
+
+// Fatal marks err as one the client is disconnected for, once its error
+// frame has been sent.
+func Fatal(err error) error {
+	return &fatalError{err: err}
+}
+
+// IsFatal reports whether err was marked with Fatal.
+func IsFatal(err error) bool {
+	var fe *fatalError
+	return errors.As(err, &fe)
+}
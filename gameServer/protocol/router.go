@@ -0,0 +1,62 @@
+package protocol
+
+import "fmt"
+
+// handler decodes a message and handles it.
+type handler func(playerID string, data []byte) error
+
+// Router dispatches the messages of one game by type. Handlers are
+// registered with Handle before the game starts; Dispatch may then be
+// called from any goroutine.
+type Router struct {
+	handlers map[string]handler
+	typed    map[string]any // the fn passed to Handle, by type
+	binary   map[byte]handler
+}
+
+func NewRouter() *Router {
+	return &Router{
+		handlers: make(map[string]handler),
+		typed:    make(map[string]any),
+		binary:   make(map[byte]handler),
+	}
+}
+
+// Handle registers fn for messages of msgType. Each message is decoded into
+// a new M before fn is called. It panics if msgType already has a handler.
+func Handle[M any](r *Router, msgType string, fn func(playerID string, msg M) error) {
+	if _, dup := r.handlers[msgType]; dup {
+		panic(fmt.Sprintf("protocol: handler for %q registered twice", msgType))
+	}
+	r.typed[msgType] = fn
+	r.handlers[msgType] = func(playerID string, data []byte) error {
+		var msg M
+		if err := Decode(data, msgType, &msg); err != nil {
+			return err
+		}
+		return fn(playerID, msg)
+	}
+}
+
+// Dispatch routes one message from playerID to its handler. It returns a
+// *DecodeError for malformed or unknown messages, otherwise the handler's
+// error.
+func (r *Router) Dispatch(playerID string, data []byte) error {
+	if IsBinary(data) {
+		h, ok := r.binary[data[0]]
+		if !ok {
+			return &DecodeError{Type: fmt.Sprintf("binary 0x%02x", data[0]), Err: ErrUnknownType}
+		}
+		return h(playerID, data)
+	}
+
+	msgType, err := TypeOf(data)
+	if err != nil {
+		return err
+	}
+	h, ok := r.handlers[msgType]
+	if !ok {
+		return &DecodeError{Type: msgType, Err: ErrUnknownType}
+	}
+	return h(playerID, data)
+}
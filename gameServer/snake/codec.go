@@ -0,0 +1,171 @@
+package snake
+
+import (
+	"errors"
+
+	"github.com/simplegameserver/gameserver/protocol"
+)
+
+// Binary encoding of the snake messages, used instead of JSON for clients
+// that agreed to protocol.CapBinary. Numbers are unsigned varints unless
+// noted, strings a length followed by UTF-8 bytes.
+//
+//	gameState (server to client):
+//	  0x01
+//	  food count, then x, y of each food
+//	  player count, then for each player:
+//	    id, score, direction x, direction y (signed varints),
+//	    body length, head x, head y, then the remaining segments as 2-bit
+//	    steps from the previous segment, four per byte, first step in the
+//	    low bits
+//	direction (client to server):
+//	  0x02, one step
+//	keyframe, the gameState sent to delta clients (server to client):
+//	  0x03, seq, then the gameState fields after 0x01
+//	gameDelta (server to client):
+//	  0x04, seq
+//	  left count, then the id of each snake
+//	  joined count, then each player as in gameState
+//	  reset count, then each player as in gameState
+//	  move count, then for each move: id, head x, head y, 1 if the tail
+//	  was removed else 0
+//	  removed food count, then x, y of each food
+//	  added food count, then x, y of each food
+//	keyframe request (client to server):
+//	  0x05
+//
+// Steps are 0 up (y-1), 1 right (x+1), 2 down (y+1) and 3 left (x-1).
+const (
+	kindGameState       byte = 0x01
+	kindDirection       byte = 0x02
+	kindKeyframe        byte = 0x03
+	kindDelta           byte = 0x04
+	kindKeyframeRequest byte = 0x05
+)
+
+var steps = [4]Position{{X: 0, Y: -1}, {X: 1, Y: 0}, {X: 0, Y: 1}, {X: -1, Y: 0}}
+
+var errNotContiguous = errors.New("snake body is not contiguous")
+
+// stepOf returns the step code of d, or false if d is not a unit vector.
+func stepOf(d Position) (byte, bool) {
+	for i, s := range steps {
+		if s == d {
+			return byte(i), true
+		}
+	}
+	return 0, false
+}
+
+// encodeState encodes the players and foods of a gameState message.
+func encodeState(players map[string]*Player, foods []Food) ([]byte, error) {
+	return appendState([]byte{kindGameState}, players, foods)
+}
+
+// encodeKeyframe encodes a gameState message for delta clients.
+func encodeKeyframe(state *GameState) ([]byte, error) {
+	b := protocol.AppendUvarint([]byte{kindKeyframe}, state.Seq)
+	return appendState(b, state.Players, state.Food)
+}
+
+func encodeDelta(d *Delta) ([]byte, error) {
+	b := protocol.AppendUvarint([]byte{kindDelta}, d.Seq)
+
+	b = protocol.AppendUvarint(b, uint64(len(d.Left)))
+	for _, id := range d.Left {
+		b = protocol.AppendString(b, id)
+	}
+	for _, players := range [][]*Player{d.Joined, d.Reset} {
+		b = protocol.AppendUvarint(b, uint64(len(players)))
+		for _, p := range players {
+			var err error
+			if b, err = appendPlayer(b, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	b = protocol.AppendUvarint(b, uint64(len(d.Moves)))
+	for _, m := range d.Moves {
+		b = protocol.AppendString(b, m.ID)
+		b = protocol.AppendUvarint(b, uint64(m.Head.X))
+		b = protocol.AppendUvarint(b, uint64(m.Head.Y))
+		if m.TailRemoved {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	}
+	b = appendFoods(b, d.FoodsRemoved)
+	return appendFoods(b, d.FoodsAdded), nil
+}
+
+func appendState(b []byte, players map[string]*Player, foods []Food) ([]byte, error) {
+	b = appendFoods(b, foods)
+	b = protocol.AppendUvarint(b, uint64(len(players)))
+	for _, p := range players {
+		var err error
+		if b, err = appendPlayer(b, p); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func appendFoods(b []byte, foods []Food) []byte {
+	b = protocol.AppendUvarint(b, uint64(len(foods)))
+	for _, f := range foods {
+		b = protocol.AppendUvarint(b, uint64(f.X))
+		b = protocol.AppendUvarint(b, uint64(f.Y))
+	}
+	return b
+}
+
+func appendPlayer(b []byte, p *Player) ([]byte, error) {
+	b = protocol.AppendString(b, p.ID)
+	b = protocol.AppendUvarint(b, uint64(p.Score))
+	b = protocol.AppendVarint(b, int64(p.Direction.X))
+	b = protocol.AppendVarint(b, int64(p.Direction.Y))
+
+	b = protocol.AppendUvarint(b, uint64(len(p.Body)))
+	if len(p.Body) == 0 {
+		return b, nil
+	}
+	b = protocol.AppendUvarint(b, uint64(p.Body[0].X))
+	b = protocol.AppendUvarint(b, uint64(p.Body[0].Y))
+	var packed byte
+	for i := 1; i < len(p.Body); i++ {
+		step, ok := stepOf(Position{X: p.Body[i].X - p.Body[i-1].X, Y: p.Body[i].Y - p.Body[i-1].Y})
+		if !ok {
+			return nil, errNotContiguous
+		}
+		packed |= step << (2 * ((i - 1) % 4))
+		if (i-1)%4 == 3 || i == len(p.Body)-1 {
+			b = append(b, packed)
+			packed = 0
+		}
+	}
+	return b, nil
+}
+
+// decodeDirection decodes a binary direction message.
+func decodeDirection(data []byte) (DirectionMessage, error) {
+	r := protocol.NewReader(data)
+	r.Byte() // kind
+	step := r.Byte()
+	if err := r.Err(); err != nil {
+		return DirectionMessage{}, err
+	}
+	if int(step) >= len(steps) {
+		// The zero direction is rejected like any other non-unit vector.
+		return DirectionMessage{Type: "direction"}, nil
+	}
+	return DirectionMessage{Type: "direction", Direction: steps[step]}, nil
+}
+
+// decodeKeyframeRequest decodes a binary keyframe request.
+func decodeKeyframeRequest(data []byte) (KeyframeRequest, error) {
+	r := protocol.NewReader(data)
+	r.Byte() // kind
+	return KeyframeRequest{Type: "keyframe"}, r.Err()
+}
@@ -0,0 +1,279 @@
+package snake
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/simplegameserver/gameserver/protocol"
+)
+
+// decodeState decodes a gameState message or a keyframe. Only clients
+// decode them; the server does so in the tests to check the format.
+func decodeState(data []byte) (*GameState, error) {
+	r := protocol.NewReader(data)
+	state := &GameState{Type: "gameState", Players: make(map[string]*Player)}
+	switch kind := r.Byte(); kind {
+	case kindGameState:
+	case kindKeyframe:
+		state.Seq = r.Uvarint()
+	default:
+		return nil, fmt.Errorf("kind 0x%02x is not a game state", kind)
+	}
+	state.Food = readFoods(r)
+	for range r.Count() {
+		p := readPlayer(r)
+		state.Players[p.ID] = p
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// decodeDelta decodes a gameDelta message.
+func decodeDelta(data []byte) (*Delta, error) {
+	r := protocol.NewReader(data)
+	if kind := r.Byte(); kind != kindDelta {
+		return nil, fmt.Errorf("kind 0x%02x is not a delta", kind)
+	}
+	d := &Delta{Type: "gameDelta", Seq: r.Uvarint()}
+	for range r.Count() {
+		d.Left = append(d.Left, r.String())
+	}
+	for _, players := range []*[]*Player{&d.Joined, &d.Reset} {
+		for range r.Count() {
+			*players = append(*players, readPlayer(r))
+		}
+	}
+	for range r.Count() {
+		m := Move{ID: r.String()}
+		m.Head.X = int(r.Uvarint())
+		m.Head.Y = int(r.Uvarint())
+		m.TailRemoved = r.Byte() == 1
+		d.Moves = append(d.Moves, m)
+	}
+	d.FoodsRemoved = readFoods(r)
+	d.FoodsAdded = readFoods(r)
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func readFoods(r *protocol.Reader) []Food {
+	var foods []Food
+	for range r.Count() {
+		x, y := r.Uvarint(), r.Uvarint()
+		foods = append(foods, Food{Position{X: int(x), Y: int(y)}})
+	}
+	return foods
+}
+
+func readPlayer(r *protocol.Reader) *Player {
+	p := &Player{ID: r.String(), Score: int(r.Uvarint())}
+	p.Direction.X = int(r.Varint())
+	p.Direction.Y = int(r.Varint())
+
+	n := r.Uvarint()
+	if n == 0 {
+		p.Body = []Position{}
+		return p
+	}
+	x, y := r.Uvarint(), r.Uvarint()
+	p.Body = []Position{{X: int(x), Y: int(y)}}
+	var packed byte
+	for i := uint64(1); i < n; i++ {
+		if (i-1)%4 == 0 {
+			if r.Len() == 0 {
+				r.Byte() // fails, the message is cut short
+				break
+			}
+			packed = r.Byte()
+		}
+		step := steps[(packed>>(2*((i-1)%4)))&3]
+		prev := p.Body[i-1]
+		p.Body = append(p.Body, Position{X: prev.X + step.X, Y: prev.Y + step.Y})
+	}
+	return p
+}
+
+// snakeOf builds a contiguous body of n segments from head, turning
+// clockwise every three segments so every step code is used.
+func snakeOf(id string, head Position, n int) *Player {
+	body := []Position{head}
+	dir := 1
+	for i := 1; i < n; i++ {
+		if i%3 == 0 {
+			dir = (dir + 1) % 4
+		}
+		prev := body[i-1]
+		body = append(body, Position{X: prev.X + steps[dir].X, Y: prev.Y + steps[dir].Y})
+	}
+	return &Player{ID: id, Body: body, Direction: steps[(dir+2)%4], Score: n - 1}
+}
+
+// arena has snakes of body lengths 1, 2, 5 and 9, so the 2-bit steps fill
+// no byte, part of one, exactly one and exactly two.
+func arena() map[string]*Player {
+	return map[string]*Player{
+		"a": snakeOf("a", Position{X: 10, Y: 10}, 1),
+		"b": snakeOf("b", Position{X: 3, Y: 20}, 2),
+		"c": snakeOf("c", Position{X: 15, Y: 4}, 5),
+		"d": snakeOf("d", Position{X: 200, Y: 150}, 9),
+	}
+}
+
+func foods() []Food {
+	return []Food{{Position{X: 0, Y: 0}}, {Position{X: 29, Y: 7}}, {Position{X: 300, Y: 1}}}
+}
+
+// sameJSON fails t unless got and want marshal to the same JSON.
+func sameJSON(t *testing.T, got, want any) {
+	t.Helper()
+	g, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(g) != string(w) {
+		t.Errorf("decoded\n%s\nwant\n%s", g, w)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	players := arena()
+	data, err := encodeState(players, foods())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeState(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameJSON(t, got, GameState{Type: "gameState", Players: players, Food: foods()})
+}
+
+func TestKeyframeRoundTrip(t *testing.T) {
+	state := &GameState{Type: "gameState", Seq: 1234, Players: arena(), Food: foods()}
+	data, err := encodeKeyframe(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeState(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameJSON(t, got, state)
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	players := arena()
+	delta := &Delta{
+		Type:   "gameDelta",
+		Seq:    77,
+		Left:   []string{"gone", "also gone"},
+		Joined: []*Player{players["a"], players["d"]},
+		Reset:  []*Player{players["b"]},
+		Moves: []Move{
+			{ID: "c", Head: Position{X: 16, Y: 4}, TailRemoved: true},
+			// e ate, its tail stays.
+			{ID: "e", Head: Position{X: 0, Y: 29}, TailRemoved: false},
+		},
+		FoodsRemoved: foods()[:1],
+		FoodsAdded:   foods()[1:],
+	}
+	data, err := encodeDelta(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeDelta(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameJSON(t, got, delta)
+}
+
+func TestEmptyDeltaRoundTrip(t *testing.T) {
+	delta := &Delta{Type: "gameDelta", Seq: 1}
+	data, err := encodeDelta(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeDelta(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameJSON(t, got, delta)
+}
+
+func TestStepPacking(t *testing.T) {
+	for _, n := range []int{1, 2, 5, 9} {
+		p := snakeOf("p", Position{X: 50, Y: 50}, n)
+		data, err := encodeState(map[string]*Player{"p": p}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// kind, no food, one player, id, score, direction, length, head,
+		// then the steps four per byte.
+		want := 1 + 1 + 1 + 2 + 1 + 2 + 1 + 2 + (n-1+3)/4
+		if len(data) != want {
+			t.Errorf("length %d: encoded in %d bytes, want %d", n, len(data), want)
+		}
+		got, err := decodeState(data)
+		if err != nil {
+			t.Fatalf("length %d: %v", n, err)
+		}
+		sameJSON(t, got.Players["p"], p)
+	}
+}
+
+func TestEncodeNotContiguous(t *testing.T) {
+	p := &Player{ID: "p", Body: []Position{{X: 1, Y: 1}, {X: 3, Y: 1}}}
+	if _, err := encodeState(map[string]*Player{"p": p}, nil); !errors.Is(err, errNotContiguous) {
+		t.Errorf("err = %v, want %v", err, errNotContiguous)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	data, err := encodeKeyframe(&GameState{Seq: 9, Players: arena(), Food: foods()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n < len(data); n++ {
+		if _, err := decodeState(data[:n]); err == nil {
+			t.Errorf("decoding the first %d of %d bytes succeeded", n, len(data))
+		}
+	}
+}
+
+func TestDecodeDirection(t *testing.T) {
+	for code, step := range steps {
+		msg, err := decodeDirection([]byte{kindDirection, byte(code)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Direction != step || !validDirection(msg.Direction) {
+			t.Errorf("step %d decoded as %v", code, msg.Direction)
+		}
+	}
+	msg, err := decodeDirection([]byte{kindDirection, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validDirection(msg.Direction) {
+		t.Errorf("step 4 decoded as the valid direction %v", msg.Direction)
+	}
+}
+
+func TestValidDirection(t *testing.T) {
+	for _, d := range []Position{{}, {X: 1, Y: 1}, {X: 2, Y: 0}, {X: -9223372036854775807, Y: 0}} {
+		if validDirection(d) {
+			t.Errorf("validDirection(%v) = true", d)
+		}
+	}
+}
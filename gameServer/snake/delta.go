@@ -0,0 +1,117 @@
+package snake
+
+import (
+	"encoding/json"
+	"log/slog"
+	"slices"
+
+	"github.com/simplegameserver/gameserver/game"
+	"github.com/simplegameserver/gameserver/protocol"
+)
+
+// Delta holds what changed in one tick. It is sent instead of GameState to
+// clients that agreed to protocol.CapDelta, with a full GameState as a
+// keyframe every KeyframeInterval ticks. Both carry the tick sequence
+// number: a client that sees a gap has missed a delta and asks for a
+// keyframe with a KeyframeRequest.
+//
+// Clients apply the fields in order: remove the left snakes, add the joined
+// and reset ones, move every snake in Moves, then update the food.
+type Delta struct {
+	Type         string    `json:"type"` // Always "gameDelta"
+	Seq          uint64    `json:"seq"`
+	Left         []string  `json:"left,omitempty"`
+	Joined       []*Player `json:"joined,omitempty"`
+	Reset        []*Player `json:"reset,omitempty"`
+	Moves        []Move    `json:"moves,omitempty"`
+	FoodsRemoved []Food    `json:"foodsRemoved,omitempty"`
+	FoodsAdded   []Food    `json:"foodsAdded,omitempty"`
+}
+
+// Move is one step of a snake. A snake whose tail was not removed ate a
+// food and scored a point.
+type Move struct {
+	ID          string   `json:"id"`
+	Head        Position `json:"head"`
+	TailRemoved bool     `json:"tailRemoved"`
+}
+
+// KeyframeRequest asks for a full state on the next tick.
+type KeyframeRequest struct {
+	Type string `json:"type"` // Always "keyframe"
+}
+
+func (g *Game) handleKeyframe(playerID string, _ KeyframeRequest) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if player, exists := g.players[playerID]; exists {
+		player.needKeyframe = true
+	}
+	if s, exists := g.spectators[playerID]; exists {
+		s.needKeyframe = true
+	}
+	return nil
+}
+
+// spectatorMessage reports whether data is a KeyframeRequest or a chat
+// message, the only messages spectators may send.
+func spectatorMessage(data []byte) bool {
+	if protocol.IsBinary(data) {
+		return data[0] == kindKeyframeRequest
+	}
+	msgType, _ := protocol.TypeOf(data)
+	return msgType == "keyframe" || msgType == "chat"
+}
+
+// dropPlayers removes the moves and resets of the given players, which are
+// sent whole in Joined instead.
+func (d *Delta) dropPlayers(ids map[string]bool) {
+	d.Moves = slices.DeleteFunc(d.Moves, func(m Move) bool { return ids[m.ID] })
+	d.Reset = slices.DeleteFunc(d.Reset, func(p *Player) bool { return ids[p.ID] })
+}
+
+// frames encodes the messages of one tick on first use, so a tick only pays
+// for the encodings its clients asked for.
+type frames struct {
+	log   *slog.Logger
+	state *GameState
+	delta *Delta
+
+	json, binary, binaryKeyframe, deltaJSON, deltaBinary []byte
+}
+
+// For returns the frame to send on conn, empty if it could not be encoded.
+func (f *frames) For(conn *game.Conn, keyframe bool) []byte {
+	binary := conn.Has(protocol.CapBinary)
+	if !conn.Has(protocol.CapDelta) {
+		if binary {
+			return f.encode(&f.binary, func() ([]byte, error) {
+				return encodeState(f.state.Players, f.state.Food)
+			})
+		}
+		return f.encode(&f.json, func() ([]byte, error) { return json.Marshal(f.state) })
+	}
+
+	switch {
+	case keyframe && binary:
+		return f.encode(&f.binaryKeyframe, func() ([]byte, error) { return encodeKeyframe(f.state) })
+	case keyframe:
+		return f.encode(&f.json, func() ([]byte, error) { return json.Marshal(f.state) })
+	case binary:
+		return f.encode(&f.deltaBinary, func() ([]byte, error) { return encodeDelta(f.delta) })
+	default:
+		return f.encode(&f.deltaJSON, func() ([]byte, error) { return json.Marshal(f.delta) })
+	}
+}
+
+func (f *frames) encode(dst *[]byte, enc func() ([]byte, error)) []byte {
+	if *dst == nil {
+		msg, err := enc()
+		if err != nil {
+			f.log.Error("encode game state", "err", err)
+			msg = []byte{} // không encode lại cho từng người chơi
+		}
+		*dst = msg
+	}
+	return *dst
+}
@@ -0,0 +1,198 @@
+package snake
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/simplegameserver/gameserver/storage"
+)
+
+// Leaderboard periods. Daily and weekly boards start over at midnight UTC,
+// weekly ones on Monday.
+const (
+	PeriodAllTime = "all"
+	PeriodDaily   = "daily"
+	PeriodWeekly  = "weekly"
+)
+
+var periods = []string{PeriodAllTime, PeriodDaily, PeriodWeekly}
+
+// Entry is one player on a board, with the best score of their runs in
+// the period.
+type Entry struct {
+	Rank     int    `json:"rank"`
+	PlayerID string `json:"playerId"`
+	Name     string `json:"name"`
+	Score    int    `json:"score"`
+	Time     int64  `json:"time"` // Unix milliseconds the run ended
+}
+
+// Board is a high-score table, served over HTTP and pushed to the arena as
+// a "leaderboard" message when a run breaks into it; PlayerID is then the
+// player whose run did.
+type Board struct {
+	Type     string  `json:"type"` // Always "leaderboard"
+	Period   string  `json:"period"`
+	PlayerID string  `json:"playerId,omitempty"`
+	Entries  []Entry `json:"entries"`
+}
+
+// board is the best size players since since, zero for the all-time board.
+type board struct {
+	since   time.Time
+	entries []Entry // best first
+}
+
+// Leaderboard keeps the all-time, daily and weekly high scores of every
+// snake arena played with the default rules; custom runs are left out. The
+// boards are rebuilt from the runs in storage when it is created and kept
+// up to date by Record. It is safe for concurrent use.
+type Leaderboard struct {
+	size int
+
+	mu     sync.Mutex
+	boards map[string]*board
+}
+
+// NewLeaderboard creates boards of the best size players from the runs in
+// store.
+func NewLeaderboard(store storage.Storage, size int) (*Leaderboard, error) {
+	l := &Leaderboard{size: size, boards: make(map[string]*board)}
+	now := time.Now()
+	for _, period := range periods {
+		l.boards[period] = &board{since: periodStart(period, now)}
+	}
+	// The all-time board reads every run, the others only their own.
+	err := store.EachSnakeRun(time.Time{}, func(run storage.SnakeRun) {
+		for _, b := range l.boards {
+			if !run.Ended.Before(b.since) {
+				l.insert(b, run)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// periodStart returns when the board of period containing t started.
+func periodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case PeriodDaily:
+		return day
+	case PeriodWeekly:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	default:
+		return time.Time{}
+	}
+}
+
+// Record adds a finished run and returns the boards it broke into.
+func (l *Leaderboard) Record(run storage.SnakeRun) []Board {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var changed []Board
+	for _, period := range periods {
+		b := l.current(period, run.Ended)
+		if b == nil || !l.insert(b, run) {
+			continue
+		}
+		changed = append(changed, Board{
+			Type:     "leaderboard",
+			Period:   period,
+			PlayerID: run.PlayerID,
+			Entries:  append([]Entry{}, b.entries...),
+		})
+	}
+	return changed
+}
+
+// Board returns the current board of period and whether period exists.
+func (l *Leaderboard) Board(period string) (Board, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.boards[period]; !ok {
+		return Board{}, false
+	}
+	b := l.current(period, time.Now())
+	return Board{Type: "leaderboard", Period: period, Entries: append([]Entry{}, b.entries...)}, true
+}
+
+// current returns the board of period at t, starting it over if t is in a
+// new period, or nil if t is before the current one. It must be called
+// with l.mu held.
+func (l *Leaderboard) current(period string, t time.Time) *board {
+	b := l.boards[period]
+	since := periodStart(period, t)
+	if since.Before(b.since) {
+		return nil
+	}
+	if since.After(b.since) {
+		b.since = since
+		b.entries = nil
+	}
+	return b
+}
+
+// insert adds run to b if it is the best of its player and good enough for
+// the board, and reports whether it was added.
+func (l *Leaderboard) insert(b *board, run storage.SnakeRun) bool {
+	if run.Score <= 0 || run.Custom {
+		return false
+	}
+	i := slices.IndexFunc(b.entries, func(e Entry) bool { return e.PlayerID == run.PlayerID })
+	if i >= 0 {
+		if b.entries[i].Score >= run.Score {
+			return false
+		}
+		b.entries = slices.Delete(b.entries, i, i+1)
+	}
+	// Equal scores keep the earlier run first.
+	pos, _ := slices.BinarySearchFunc(b.entries, run.Score, func(e Entry, score int) int {
+		if e.Score >= score {
+			return -1
+		}
+		return 1
+	})
+	if pos >= l.size {
+		return false
+	}
+	b.entries = slices.Insert(b.entries, pos, Entry{
+		PlayerID: run.PlayerID,
+		Name:     run.Name,
+		Score:    run.Score,
+		Time:     run.Ended.UnixMilli(),
+	})
+	if len(b.entries) > l.size {
+		b.entries = b.entries[:l.size]
+	}
+	for i := range b.entries {
+		b.entries[i].Rank = i + 1
+	}
+	return true
+}
+
+// ServeHTTP answers GET /snake/leaderboard?period=daily with a Board. The
+// period defaults to "all". The client calls it from another origin, so it
+// must be wrapped with game.CORS.
+func (l *Leaderboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = PeriodAllTime
+	}
+	b, ok := l.Board(period)
+	if !ok {
+		http.Error(w, "period must be one of all, daily, weekly", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
@@ -0,0 +1,6 @@
+package snake
+
+import "github.com/simplegameserver/gameserver/metrics"
+
+var invalidDirections = metrics.NewCounter("gameserver_snake_invalid_directions_total",
+	"Direction messages rejected because they were not a unit vector.")
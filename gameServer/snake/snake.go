@@ -2,41 +2,47 @@ package snake
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
 	"math/rand"
-	"net/http"
+	"slices"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/simplegameserver/gameserver/auth"
+	"github.com/simplegameserver/gameserver/chat"
+	"github.com/simplegameserver/gameserver/config"
+	"github.com/simplegameserver/gameserver/game"
+	"github.com/simplegameserver/gameserver/protocol"
+	"github.com/simplegameserver/gameserver/storage"
 )
 
-const (
-	// Định nghĩa số ô mong muốn
-	numCells   = 30
-	canvasSize = 600
-
-	initSize = 3
-)
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
 type Position struct {
 	X int `json:"x"`
 	Y int `json:"y"`
 }
 
 type Player struct {
-	ID        string          `json:"id"`
-	Body      []Position      `json:"body"`
-	Direction Position        `json:"direction"`
-	Score     int             `json:"score"`
-	Conn      *websocket.Conn `json:"-"`
+	ID        string     `json:"id"`
+	Body      []Position `json:"body"`
+	Direction Position   `json:"direction"`
+	Score     int        `json:"score"`
+	Conn      *game.Conn `json:"-"`
+
+	name              string    // session name, shown in chat
+	started           time.Time // spawn of the snake, see storage.SnakeRun
+	invalidDirections int       // malformed direction messages sent so far
+	needKeyframe      bool      // send a full state instead of a delta next tick
+	suspended         bool      // connection lost, the snake waits for a resume
+}
+
+// spectator watches the arena without a snake.
+type spectator struct {
+	Conn         *game.Conn
+	name         string
+	needKeyframe bool
 }
 
 type Food struct {
@@ -45,6 +51,7 @@ type Food struct {
 
 type GameState struct {
 	Type    string             `json:"type"`
+	Seq     uint64             `json:"seq"` // tick number, see Delta
 	Players map[string]*Player `json:"players"`
 	Food    []Food             `json:"foods"`
 }
@@ -54,9 +61,10 @@ type DirectionMessage struct {
 	Direction Position `json:"direction"`
 }
 
+// InitMessage is the first message of a connection. The player ID comes
+// from the session token, not from the client.
 type InitMessage struct {
-	Type     string `json:"type"`
-	PlayerID string `json:"playerId"`
+	Type string `json:"type"`
 }
 
 type PlayerJoinedOrLeaveMessages struct {
@@ -65,28 +73,92 @@ type PlayerJoinedOrLeaveMessages struct {
 	TotalPlayer int      `json:"totalPlayer"`
 }
 
-// Global variables
-var (
-	players             = make(map[string]*Player)
-	foods               = make([]Food, 0)
-	joinOrLeaveMessages = PlayerJoinedOrLeaveMessages{
-		Type:        "playerJoinedOrLeave",
-		Message:     []string{},
-		TotalPlayer: 0,
+// Game is one snake arena. The zero value is not usable, create it with New.
+type Game struct {
+	rules config.Snake
+	// maxInvalid is how many malformed directions a player may send
+	// before being disconnected.
+	maxInvalid int
+	room       string
+	log        *slog.Logger
+	router     *protocol.Router
+	chat       *chat.Room
+	store      storage.Storage
+	scores     *Leaderboard // may be nil
+	custom     bool         // rules overridden for this room, runs are not ranked
+
+	mu                  sync.Mutex
+	players             map[string]*Player
+	spectators          map[string]*spectator
+	foods               []Food
+	joinOrLeaveMessages PlayerJoinedOrLeaveMessages
+
+	seq    uint64   // number of the last tick
+	joined []string // players joined since the last tick
+	left   []string // players left since the last tick
+}
+
+// Factory creates arenas with the given rules, overridden per room, that
+// record their runs on scores and disconnect players after
+// limits.MaxInvalidDirections malformed directions.
+func Factory(rules config.Snake, limits config.RateLimit, scores *Leaderboard) game.Factory {
+	return func(env game.Env) (game.Game, error) {
+		// Each room gets its own copy, overrides must not leak to later rooms.
+		rules := rules
+		if err := config.Override(&rules, env.Overrides); err != nil {
+			return nil, err
+		}
+		g := New(rules, env, scores)
+		g.maxInvalid = limits.MaxInvalidDirections
+		g.custom = len(env.Overrides) > 0
+		return g, nil
 	}
-	mu sync.Mutex
-)
+}
+
+// New creates an arena of room env.Room with its initial food already
+// placed. Runs are recorded on scores unless it is nil.
+func New(rules config.Snake, env game.Env, scores *Leaderboard) *Game {
+	g := &Game{
+		rules:      rules,
+		maxInvalid: config.Default().RateLimit.MaxInvalidDirections,
+		scores:     scores,
+		room:       env.Room,
+		log:        env.Logger,
+		router:     protocol.NewRouter(),
+		chat:       env.Chat,
+		store:      env.Storage,
+		players:    make(map[string]*Player),
+		spectators: make(map[string]*spectator),
+		foods:      make([]Food, 0, rules.Foods),
+		joinOrLeaveMessages: PlayerJoinedOrLeaveMessages{
+			Type:        "playerJoinedOrLeave",
+			Message:     []string{},
+			TotalPlayer: 0,
+		},
+	}
+	protocol.Handle(g.router, "direction", g.handleDirection)
+	protocol.HandleBinary(g.router, kindDirection, "direction", decodeDirection)
+	protocol.Handle(g.router, "keyframe", g.handleKeyframe)
+	protocol.HandleBinary(g.router, kindKeyframeRequest, "keyframe", decodeKeyframeRequest)
+	protocol.Handle(g.router, "chat", g.handleChat)
+	for range rules.Foods {
+		g.foods = append(g.foods, g.generateFood())
+	}
+	return g
+}
 
-func generateFood() Food {
+func (g *Game) generateFood() Food {
 	return Food{
 		Position: Position{
-			X: rand.Intn(numCells),
-			Y: rand.Intn(numCells),
+			X: rand.Intn(g.rules.NumCells),
+			Y: rand.Intn(g.rules.NumCells),
 		},
 	}
 }
 
-func initPlayer(id string) *Player {
+func (g *Game) initPlayer(id string) *Player {
+	numCells, initSize := g.rules.NumCells, g.rules.InitSize
+
 	// Đặt vị trí bắt đầu trong phạm vi số ô mới
 	startX := rand.Intn(numCells-initSize*2) + initSize // Cách lề trái ít nhất initSize ô
 	startY := rand.Intn(numCells)
@@ -101,102 +173,236 @@ func initPlayer(id string) *Player {
 		Body:      body,
 		Direction: Position{X: 1, Y: 0}, // Hướng sang phải ban đầu
 		Score:     0,
+		started:   time.Now(),
 		// Conn sẽ được gán sau khi kết nối
 	}
 }
 
-func pingPlayer(playerID string, conn *websocket.Conn) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+func (g *Game) Join(conn *game.Conn, session auth.Session, init []byte) error {
+	var initMsg InitMessage
+	if err := json.Unmarshal(init, &initMsg); err != nil || initMsg.Type != "init" {
+		return protocol.ErrInvalidInit
+	}
 
-	for range ticker.C {
-		if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second)); err != nil {
-			log.Printf("Ping failed for player %s: %v", playerID, err)
-			handlePlayerDisconnect(playerID)
-			return
-		}
+	playerID := session.PlayerID
+
+	g.mu.Lock()
+	_, playing := g.players[playerID]
+	_, watching := g.spectators[playerID]
+	if playing || watching {
+		// Replacing the snake would leave the old connection's read loop
+		// to remove the new one when it ends.
+		g.mu.Unlock()
+		return protocol.ErrDuplicateSession
 	}
+	if conn.Spectator() {
+		g.spectators[playerID] = &spectator{Conn: conn, name: session.Name, needKeyframe: true}
+		g.sendPlayerCount(conn)
+		conn.SendJSON(g.chat.History())
+		g.mu.Unlock()
+		g.log.Info("spectator joined", "player_id", playerID)
+		return nil
+	}
+	g.players[playerID] = g.initPlayer(playerID)
+	g.players[playerID].Conn = conn
+	g.players[playerID].name = session.Name
+	g.players[playerID].needKeyframe = true
+	g.joined = append(g.joined, playerID)
+	conn.SendJSON(g.chat.History())
+	g.mu.Unlock()
+
+	g.notifyPlayerJoinedAndLeave(playerID, "join")
+	g.log.Info("player joined", "player_id", playerID)
+	return nil
 }
 
-func handlePlayerDisconnect(playerID string) {
-	mu.Lock()
-	if player, exists := players[playerID]; exists {
+func (g *Game) Leave(playerID string) {
+	g.mu.Lock()
+	if s, exists := g.spectators[playerID]; exists {
+		s.Conn.Close()
+		delete(g.spectators, playerID)
+		g.mu.Unlock()
+		g.log.Info("spectator left", "player_id", playerID)
+		return
+	}
+	if player, exists := g.players[playerID]; exists {
 		player.Conn.Close()
-		delete(players, playerID)
-		mu.Unlock()
-		notifyPlayerJoinedAndLeave(playerID, "leave")
-		log.Printf("Player %s disconnected", playerID)
+		g.recordRun(player, "disconnect")
+		delete(g.players, playerID)
+		g.left = append(g.left, playerID)
+		g.mu.Unlock()
+		g.notifyPlayerJoinedAndLeave(playerID, "leave")
+		g.log.Info("player left", "player_id", playerID)
 	} else {
-		mu.Unlock()
+		g.mu.Unlock()
 	}
 }
 
-func HandleConnection(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		fmt.Println("Websocket error: ", err)
-		return
+// Suspend freezes the snake of a player whose connection was lost, so it
+// keeps its length and score until they resume.
+func (g *Game) Suspend(playerID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if player, exists := g.players[playerID]; exists {
+		player.suspended = true
+		g.log.Info("player suspended", "player_id", playerID)
 	}
+}
 
-	// Thiết lập các parameters cho connection
-	conn.SetReadLimit(512) // Giới hạn kích thước message
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
+// Resume gives the snake back to the player on conn. The next tick sends
+// them a keyframe.
+func (g *Game) Resume(conn *game.Conn, playerID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	player, exists := g.players[playerID]
+	if !exists {
+		return false
+	}
+	player.Conn = conn
+	player.suspended = false
+	player.needKeyframe = true
+	g.sendPlayerCount(conn)
+	conn.SendJSON(g.chat.History())
+	g.log.Info("player resumed", "player_id", playerID)
+	return true
+}
+
+// sendPlayerCount tells a client that did not see the joins so far how many
+// players there are. It must be called with g.mu held.
+func (g *Game) sendPlayerCount(conn *game.Conn) {
+	conn.SendJSON(PlayerJoinedOrLeaveMessages{
+		Type:        "playerJoinedOrLeave",
+		Message:     []string{},
+		TotalPlayer: g.joinOrLeaveMessages.TotalPlayer,
 	})
+}
 
-	var initMsg InitMessage
-	err = conn.ReadJSON(&initMsg)
-	if err != nil || initMsg.Type != "init" {
-		fmt.Println("Failed to read init message: ", err)
-		conn.Close()
-		return
+// Players returns the IDs of the players in the arena, sorted.
+func (g *Game) Players() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return slices.Sorted(maps.Keys(g.players))
+}
+
+// Kick closes the player's connection with a "kicked" close frame and
+// removes their snake.
+func (g *Game) Kick(playerID string) bool {
+	g.mu.Lock()
+	var conn *game.Conn
+	if player, exists := g.players[playerID]; exists {
+		conn = player.Conn
+	} else if s, watching := g.spectators[playerID]; watching {
+		conn = s.Conn // spectators can be kicked too, e.g. for spamming chat
+	}
+	if conn != nil {
+		conn.Kick()
+	}
+	g.mu.Unlock()
+	if conn == nil {
+		return false
 	}
+	g.log.Info("player kicked", "player_id", playerID)
+	g.Leave(playerID)
+	return true
+}
 
-	playerID := initMsg.PlayerID
+// Command implements game.Moderator. Snake has no admin commands.
+func (g *Game) Command(name string) error {
+	return game.ErrUnknownCommand
+}
 
-	mu.Lock()
-	players[playerID] = initPlayer(playerID)
-	players[playerID].Conn = conn
-	mu.Unlock()
+func (g *Game) HandleMessage(playerID string, data []byte) error {
+	g.mu.Lock()
+	_, watching := g.spectators[playerID]
+	g.mu.Unlock()
+	if watching && !spectatorMessage(data) {
+		return protocol.ErrSpectator
+	}
+	err := g.router.Dispatch(playerID, data)
+	var decodeErr *protocol.DecodeError
+	if errors.As(err, &decodeErr) && decodeErr.Type == "direction" {
+		// A direction that does not even decode counts like an invalid one.
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if player, exists := g.players[playerID]; exists {
+			return g.rejectDirection(player, err, Position{})
+		}
+	}
+	return err
+}
 
-	notifyPlayerJoinedAndLeave(playerID, "join")
-	log.Println("Joined player with id:", playerID)
+// handleChat posts a chat message of a player or spectator and broadcasts
+// it to the arena.
+func (g *Game) handleChat(playerID string, msg chat.SendMessage) error {
+	g.mu.Lock()
+	var name string
+	if player, exists := g.players[playerID]; exists {
+		name = player.name
+	} else if s, exists := g.spectators[playerID]; exists {
+		name = s.name
+	}
+	g.mu.Unlock()
 
-	// Khởi động goroutine cho ping
-	go pingPlayer(playerID, conn)
-	// Handle messages
-	for {
-		var msg DirectionMessage
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("Player disconnected: %s", playerID)
-			handlePlayerDisconnect(playerID)
-			break
-		}
+	posted, err := g.chat.Post(playerID, name, msg.Text)
+	if err != nil {
+		return err
+	}
+	messageJSON, err := json.Marshal(posted)
+	if err != nil {
+		return err
+	}
+	g.broadcast(messageJSON)
+	return nil
+}
 
-		if msg.Type == "direction" {
-			mu.Lock()
-			if player, exists := players[playerID]; exists {
-				// Prevent 180-degree turns
-				if !(player.Direction.X == -msg.Direction.X && player.Direction.Y == -msg.Direction.Y) {
-					player.Direction = msg.Direction
-				}
-			}
-			mu.Unlock()
-		}
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+func (g *Game) handleDirection(playerID string, msg DirectionMessage) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	player, exists := g.players[playerID]
+	if !exists {
+		return nil
+	}
+	if !validDirection(msg.Direction) {
+		return g.rejectDirection(player, errInvalidDirection, msg.Direction)
+	}
+	// Prevent 180-degree turns
+	if !(player.Direction.X == -msg.Direction.X && player.Direction.Y == -msg.Direction.Y) {
+		player.Direction = msg.Direction
 	}
+	return nil
 }
 
-func notifyPlayerJoinedAndLeave(playerId string, joinOrLeave string) {
+var errInvalidDirection = protocol.NewError(protocol.CodeInvalidDirection, "direction must be a unit vector")
+
+// validDirection reports whether d is one of the four unit vectors. Anything
+// else would let a snake jump cells or move diagonally.
+func validDirection(d Position) bool {
+	_, ok := stepOf(d)
+	return ok
+}
+
+// rejectDirection counts an invalid or malformed direction d and returns
+// err, the error the client is sent; players that keep sending them are
+// disconnected. It must be called with g.mu held.
+func (g *Game) rejectDirection(player *Player, err error, d Position) error {
+	invalidDirections.Inc()
+	player.invalidDirections++
+	if player.invalidDirections < g.maxInvalid {
+		g.log.Debug("invalid direction", "player_id", player.ID, "x", d.X, "y", d.Y, "err", err)
+		return err
+	}
+	g.log.Warn("player flagged for invalid directions, disconnecting",
+		"player_id", player.ID, "count", player.invalidDirections, "x", d.X, "y", d.Y, "err", err)
+	return protocol.Fatal(err)
+}
+
+func (g *Game) notifyPlayerJoinedAndLeave(playerId string, joinOrLeave string) {
 	joinOrLeaveText := fmt.Sprintf("Player %s %s the game", playerId, joinOrLeave) // Đổi tên biến
 
-	mu.Lock()
-	// Cập nhật trạng thái global trước
-	joinOrLeaveMessages.Message = append(joinOrLeaveMessages.Message, joinOrLeaveText)
-	newTotalPlayers := joinOrLeaveMessages.TotalPlayer
+	g.mu.Lock()
+	// Cập nhật trạng thái trước
+	g.joinOrLeaveMessages.Message = append(g.joinOrLeaveMessages.Message, joinOrLeaveText)
+	newTotalPlayers := g.joinOrLeaveMessages.TotalPlayer
 	if joinOrLeave == "join" {
 		newTotalPlayers++
 	} else if joinOrLeave == "leave" {
@@ -205,7 +411,7 @@ func notifyPlayerJoinedAndLeave(playerId string, joinOrLeave string) {
 			newTotalPlayers = 0
 		} // Đảm bảo không âm
 	}
-	joinOrLeaveMessages.TotalPlayer = newTotalPlayers
+	g.joinOrLeaveMessages.TotalPlayer = newTotalPlayers
 
 	// Chuẩn bị message để gửi (chỉ chứa tin nhắn mới nhất)
 	msgToSend := PlayerJoinedOrLeaveMessages{
@@ -213,203 +419,257 @@ func notifyPlayerJoinedAndLeave(playerId string, joinOrLeave string) {
 		Message:     []string{joinOrLeaveText}, // Chỉ gửi tin nhắn mới nhất
 		TotalPlayer: newTotalPlayers,
 	}
-	mu.Unlock() // Mở khóa trước khi marshal và broadcast
+	g.mu.Unlock() // Mở khóa trước khi marshal và broadcast
 
 	messageJSON, err := json.Marshal(msgToSend)
 	if err != nil {
-		log.Println("JSON Marshal error in notify:", err)
+		g.log.Error("marshal join/leave notification", "err", err)
 		return
 	}
 
-	// Sử dụng cơ chế broadcast không khóa lâu
-	broadcastNotification(messageJSON)
+	g.broadcast(messageJSON)
 }
 
-func GameLoop() {
-	// Initialize foods
-	mu.Lock()            // Khóa để khởi tạo food an toàn
-	if len(foods) == 0 { // Chỉ khởi tạo nếu chưa có food
-		for range 5 {
-			foods = append(foods, generateFood())
-		}
-	}
-	mu.Unlock()
-
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+func (g *Game) TickInterval() time.Duration {
+	return g.rules.TickInterval
+}
 
-	for range ticker.C {
-		mu.Lock() // Khóa toàn bộ quá trình cập nhật game state
+func (g *Game) Tick() {
+	g.mu.Lock() // Khóa toàn bộ quá trình cập nhật game state
 
-		playersToReset := []string{}              // Danh sách ID người chơi cần reset
-		playerUpdates := make(map[string]*Player) // Lưu trạng thái mới của player (nếu không reset)
+	playersToReset := []string{}              // Danh sách ID người chơi cần reset
+	playerUpdates := make(map[string]*Player) // Lưu trạng thái mới của player (nếu không reset)
 
-		// --- Vòng 1: Tính toán di chuyển và kiểm tra va chạm ---
-		for playerID, player := range players {
-			if player == nil || len(player.Body) == 0 { // Bỏ qua nếu player không hợp lệ
-				continue
-			}
+	g.seq++
+	delta := Delta{Type: "gameDelta", Seq: g.seq, Left: g.left}
+	g.left = nil
 
-			// Tạo vị trí đầu mới
-			newHead := Position{
-				X: player.Body[0].X + player.Direction.X,
-				Y: player.Body[0].Y + player.Direction.Y,
-			}
+	// --- Vòng 1: Tính toán di chuyển và kiểm tra va chạm ---
+	for playerID, player := range g.players {
+		if player == nil || len(player.Body) == 0 { // Bỏ qua nếu player không hợp lệ
+			continue
+		}
+		if player.suspended { // Rắn đứng yên chờ người chơi kết nối lại
+			continue
+		}
 
-			// 1. Kiểm tra va chạm tường
-			if newHead.X < 0 || newHead.X >= numCells ||
-				newHead.Y < 0 || newHead.Y >= numCells {
-				log.Printf("Player %s hit the wall.", playerID)
-				playersToReset = append(playersToReset, playerID)
-				continue // Chuyển sang người chơi tiếp theo
-			}
+		// Tạo vị trí đầu mới
+		newHead := Position{
+			X: player.Body[0].X + player.Direction.X,
+			Y: player.Body[0].Y + player.Direction.Y,
+		}
 
-			// 2. Kiểm tra va chạm với người chơi khác (bao gồm cả thân của họ)
-			collisionWithOther := false
-			for otherID, otherPlayer := range players {
-				if playerID == otherID {
-					continue
-				} // Bỏ qua chính mình
-				if otherPlayer == nil || len(otherPlayer.Body) == 0 {
-					continue
-				} // Bỏ qua player khác không hợp lệ
-
-				for _, segment := range otherPlayer.Body {
-					if newHead.X == segment.X && newHead.Y == segment.Y {
-						log.Printf("Player %s hit player %s.", playerID, otherID)
-						collisionWithOther = true
-						break
-					}
-				}
-				if collisionWithOther {
-					break
-				}
-			}
-			if collisionWithOther {
-				playersToReset = append(playersToReset, playerID)
-				continue // Chuyển sang người chơi tiếp theo
-			}
+		// 1. Kiểm tra va chạm tường
+		if newHead.X < 0 || newHead.X >= g.rules.NumCells ||
+			newHead.Y < 0 || newHead.Y >= g.rules.NumCells {
+			g.log.Debug("snake hit the wall", "player_id", playerID)
+			playersToReset = append(playersToReset, playerID)
+			continue // Chuyển sang người chơi tiếp theo
+		}
 
-			// --- Nếu không va chạm tường hoặc người khác, tiếp tục xử lý ---
+		// 2. Kiểm tra va chạm với người chơi khác (bao gồm cả thân của họ)
+		collisionWithOther := false
+		for otherID, otherPlayer := range g.players {
+			if playerID == otherID {
+				continue
+			} // Bỏ qua chính mình
+			if otherPlayer == nil || len(otherPlayer.Body) == 0 {
+				continue
+			} // Bỏ qua player khác không hợp lệ
 
-			// 3. Kiểm tra va chạm thức ăn
-			ateFood := false
-			foodIndexToRemove := -1
-			for i, food := range foods {
-				if newHead.X == food.X && newHead.Y == food.Y {
-					foodIndexToRemove = i
-					ateFood = true
-					player.Score++ // Tăng điểm trực tiếp trên player hiện tại
+			for _, segment := range otherPlayer.Body {
+				if newHead.X == segment.X && newHead.Y == segment.Y {
+					g.log.Debug("snake hit another snake", "player_id", playerID, "other_id", otherID)
+					collisionWithOther = true
 					break
 				}
 			}
-			// Xóa food đã ăn và tạo food mới (nếu có)
-			if foodIndexToRemove != -1 {
-				foods = append(foods[:foodIndexToRemove], foods[foodIndexToRemove+1:]...)
-				foods = append(foods, generateFood())
+			if collisionWithOther {
+				break
 			}
+		}
+		if collisionWithOther {
+			playersToReset = append(playersToReset, playerID)
+			continue // Chuyển sang người chơi tiếp theo
+		}
 
-			// 4. Cập nhật thân rắn
-			var newBody []Position
-			if ateFood {
-				// Thêm đầu mới vào đầu slice, giữ nguyên đuôi
-				newBody = append([]Position{newHead}, player.Body...)
-			} else {
-				// Thêm đầu mới, bỏ đuôi cũ
-				newBody = append([]Position{newHead}, player.Body[:len(player.Body)-1]...)
+		// --- Nếu không va chạm tường hoặc người khác, tiếp tục xử lý ---
+
+		// 3. Kiểm tra va chạm thức ăn
+		ateFood := false
+		foodIndexToRemove := -1
+		for i, food := range g.foods {
+			if newHead.X == food.X && newHead.Y == food.Y {
+				foodIndexToRemove = i
+				ateFood = true
+				player.Score++ // Tăng điểm trực tiếp trên player hiện tại
+				break
 			}
-			player.Body = newBody // Cập nhật body
-
-			// Lưu trạng thái player đã cập nhật để áp dụng sau
-			playerUpdates[playerID] = player
-		} // Kết thúc vòng lặp kiểm tra va chạm
-
-		// --- Vòng 2: Áp dụng các thay đổi và reset ---
+		}
+		// Xóa food đã ăn và tạo food mới (nếu có)
+		if foodIndexToRemove != -1 {
+			delta.FoodsRemoved = append(delta.FoodsRemoved, g.foods[foodIndexToRemove])
+			g.foods = append(g.foods[:foodIndexToRemove], g.foods[foodIndexToRemove+1:]...)
+			g.foods = append(g.foods, g.generateFood())
+			delta.FoodsAdded = append(delta.FoodsAdded, g.foods[len(g.foods)-1])
+		}
 
-		// Áp dụng cập nhật cho những người chơi không bị reset
-		for id, updatedPlayer := range playerUpdates {
-			// Kiểm tra xem player này có trong danh sách reset không
-			shouldReset := false
-			for _, resetID := range playersToReset {
-				if id == resetID {
-					shouldReset = true
-					break
-				}
-			}
-			if !shouldReset {
-				players[id] = updatedPlayer // Chỉ cập nhật nếu không bị reset
+		// 4. Cập nhật thân rắn
+		var newBody []Position
+		if ateFood {
+			// Thêm đầu mới vào đầu slice, giữ nguyên đuôi
+			newBody = append([]Position{newHead}, player.Body...)
+		} else {
+			// Thêm đầu mới, bỏ đuôi cũ
+			newBody = append([]Position{newHead}, player.Body[:len(player.Body)-1]...)
+		}
+		player.Body = newBody // Cập nhật body
+		delta.Moves = append(delta.Moves, Move{ID: playerID, Head: newHead, TailRemoved: !ateFood})
+
+		// Lưu trạng thái player đã cập nhật để áp dụng sau
+		playerUpdates[playerID] = player
+	} // Kết thúc vòng lặp kiểm tra va chạm
+
+	// --- Vòng 2: Áp dụng các thay đổi và reset ---
+
+	// Áp dụng cập nhật cho những người chơi không bị reset
+	for id, updatedPlayer := range playerUpdates {
+		// Kiểm tra xem player này có trong danh sách reset không
+		shouldReset := false
+		for _, resetID := range playersToReset {
+			if id == resetID {
+				shouldReset = true
+				break
 			}
 		}
+		if !shouldReset {
+			g.players[id] = updatedPlayer // Chỉ cập nhật nếu không bị reset
+		}
+	}
 
-		// Reset những người chơi đã va chạm
-		for _, playerID := range playersToReset {
-			if player, exists := players[playerID]; exists {
-				log.Printf("Resetting player %s.", playerID)
-				newPlayer := initPlayer(playerID) // Tạo player mới
-				newPlayer.Conn = player.Conn      // Giữ lại connection cũ
-				players[playerID] = newPlayer     // Thay thế player cũ trong map
-			}
+	// Reset những người chơi đã va chạm
+	for _, playerID := range playersToReset {
+		if player, exists := g.players[playerID]; exists {
+			g.log.Info("snake reset", "player_id", playerID, "score", player.Score)
+			g.recordRun(player, "collision")    // Lưu điểm của lượt chơi vừa kết thúc
+			newPlayer := g.initPlayer(playerID) // Tạo player mới
+			newPlayer.Conn = player.Conn        // Giữ lại connection cũ
+			newPlayer.name = player.name
+			// Số lần gửi hướng không hợp lệ không bị xóa khi rắn chết
+			newPlayer.invalidDirections = player.invalidDirections
+			newPlayer.needKeyframe = player.needKeyframe
+			g.players[playerID] = newPlayer // Thay thế player cũ trong map
+			delta.Reset = append(delta.Reset, newPlayer)
 		}
+	}
 
-		// --- Vòng 3: Chuẩn bị và gửi game state ---
-		// Tạo gameState với trạng thái players đã được cập nhật/reset
-		gameState := GameState{
-			Type:    "gameState",
-			Players: players,
-			Food:    foods,
+	// Người chơi mới vào được gửi nguyên con rắn thay vì move/reset
+	joined := make(map[string]bool, len(g.joined))
+	for _, id := range g.joined {
+		if player, exists := g.players[id]; exists && !joined[id] {
+			joined[id] = true
+			delta.Joined = append(delta.Joined, player)
 		}
-		stateJSON, err := json.Marshal(gameState)
-		if err != nil {
-			log.Println("Error marshaling game state:", err)
-			// Không unlock và tiếp tục vòng lặp để tránh lỗi liên tục
-		} else {
-			// Mở khóa trước khi broadcast để tránh giữ lock quá lâu
-			mu.Unlock()
-			broadcastGameState(stateJSON) // Sử dụng hàm broadcast mới
-			// Không cần Lock lại vì đã kết thúc vòng lặp tick này
+	}
+	delta.dropPlayers(joined)
+	g.joined = nil
+
+	// --- Vòng 3: Chuẩn bị và gửi game state ---
+	// Tạo gameState với trạng thái players đã được cập nhật/reset
+	gameState := GameState{
+		Type:    "gameState",
+		Seq:     g.seq,
+		Players: g.players,
+		Food:    g.foods,
+	}
+	// Client delta nhận keyframe định kỳ, khi mới vào hoặc khi yêu cầu
+	keyframe := g.seq%uint64(g.rules.KeyframeInterval) == 0
+	frames := frames{log: g.log, state: &gameState, delta: &delta}
+	// SendState không block nên có thể gửi khi đang giữ lock. Frame trước
+	// chưa gửi sẽ bị thay thế, client sẽ thiếu một delta, nên gửi keyframe.
+	for _, player := range g.players {
+		if msg := frames.For(player.Conn, keyframe || player.needKeyframe || player.Conn.StatePending()); len(msg) > 0 {
+			player.Conn.SendState(msg)
+		}
+		player.needKeyframe = false
+	}
+	for _, s := range g.spectators {
+		if msg := frames.For(s.Conn, keyframe || s.needKeyframe || s.Conn.StatePending()); len(msg) > 0 {
+			s.Conn.SendState(msg)
 		}
-		// Nếu có lỗi Marshal, Mutex vẫn đang bị khóa, vòng lặp ticker tiếp theo sẽ bị block
-		// Cần xử lý tốt hơn, ví dụ: unlock và log lỗi rồi tiếp tục
+		s.needKeyframe = false
+	}
+	g.mu.Unlock()
+}
 
-	} // Kết thúc vòng lặp ticker.C
+// Capabilities implements game.Capable.
+func (g *Game) Capabilities() []string {
+	return []string{protocol.CapBinary, protocol.CapDelta}
 }
 
-func broadcastGameState(stateJSON []byte) {
-	mu.Lock()
-	// Tạo bản sao danh sách player để tránh race condition khi handle disconnect
-	currentPlayers := make(map[string]*Player)
-	for k, v := range players {
-		currentPlayers[k] = v
+// Snapshot returns a deep copy of the arena so callers can inspect it
+// without holding the lock.
+func (g *Game) Snapshot() any {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	players := make(map[string]*Player, len(g.players))
+	for id, p := range g.players {
+		cp := *p
+		cp.Body = append([]Position(nil), p.Body...)
+		players[id] = &cp
 	}
-	mu.Unlock()
+	return GameState{
+		Type:    "gameState",
+		Players: players,
+		Food:    append([]Food(nil), g.foods...),
+	}
+}
 
-	for playerID, player := range currentPlayers {
-		if player.Conn != nil { // Kiểm tra conn không nil
-			err := player.Conn.WriteMessage(websocket.TextMessage, stateJSON)
-			if err != nil {
-				log.Printf("Failed to send game state to player %s: %v. Triggering disconnect.", playerID, err)
-				// Chạy xử lý disconnect trong goroutine riêng để tránh deadlock
-				go handlePlayerDisconnect(playerID)
-			}
+// recordRun saves the run of a snake that just died or left. It must be
+// called with g.mu held.
+func (g *Game) recordRun(player *Player, reason string) {
+	run := storage.SnakeRun{
+		Room:     g.room,
+		PlayerID: player.ID,
+		Name:     player.name,
+		Score:    player.Score,
+		Length:   len(player.Body),
+		Reason:   reason,
+		Started:  player.started,
+		Ended:    time.Now(),
+		Custom:   g.custom,
+	}
+	if err := g.store.SaveSnakeRun(run); err != nil {
+		g.log.Error("save snake run", "player_id", player.ID, "err", err)
+	}
+	if g.scores == nil {
+		return
+	}
+	for _, board := range g.scores.Record(run) {
+		g.log.Info("run entered leaderboard", "player_id", player.ID, "period", board.Period, "score", run.Score)
+		boardJSON, err := json.Marshal(board)
+		if err != nil {
+			g.log.Error("marshal leaderboard", "err", err)
+			continue
+		}
+		for _, p := range g.players {
+			p.Conn.Send(boardJSON)
+		}
+		for _, s := range g.spectators {
+			s.Conn.Send(boardJSON)
 		}
 	}
 }
 
-func broadcastNotification(messageJSON []byte) {
-	mu.Lock()
-	currentPlayers := make(map[string]*Player)
-	for k, v := range players {
-		currentPlayers[k] = v
-	}
-	mu.Unlock()
+func (g *Game) broadcast(message []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-	for playerID, player := range currentPlayers {
-		if player.Conn != nil {
-			err := player.Conn.WriteMessage(websocket.TextMessage, messageJSON)
-			if err != nil {
-				log.Printf("Failed to send notification to player %s: %v. Triggering disconnect.", playerID, err)
-				go handlePlayerDisconnect(playerID)
-			}
-		}
+	for _, player := range g.players {
+		player.Conn.Send(message)
+	}
+	for _, s := range g.spectators {
+		s.Conn.Send(message)
 	}
 }
@@ -0,0 +1,54 @@
+package snake
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/simplegameserver/gameserver/chat"
+	"github.com/simplegameserver/gameserver/config"
+	"github.com/simplegameserver/gameserver/game"
+	"github.com/simplegameserver/gameserver/storage"
+)
+
+func env(store storage.Storage, overrides map[string]string) game.Env {
+	return game.Env{
+		Room:      "test",
+		Logger:    slog.Default(),
+		Overrides: overrides,
+		Chat:      chat.NewRoom(10, chat.Chain()),
+		Storage:   store,
+	}
+}
+
+func TestOnlyDefaultRoomsRanked(t *testing.T) {
+	store := storage.NewMemory(100)
+	scores, err := NewLeaderboard(store, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newGame := Factory(config.Default().Snake, config.Default().RateLimit, scores)
+	custom, err := newGame(env(store, map[string]string{"foods": "50"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := newGame(env(store, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := def.(*Game).rules; rules != config.Default().Snake {
+		t.Errorf("default room after an overridden one: rules = %+v, want %+v", rules, config.Default().Snake)
+	}
+
+	custom.(*Game).recordRun(&Player{ID: "a", name: "a", Score: 20}, "collision")
+	def.(*Game).recordRun(&Player{ID: "b", name: "b", Score: 5}, "collision")
+
+	board, _ := scores.Board(PeriodAllTime)
+	if len(board.Entries) != 1 || board.Entries[0].PlayerID != "b" {
+		t.Errorf("board = %+v, want only the run of b", board.Entries)
+	}
+	// Both runs are still saved.
+	if runs, _ := store.SnakeRuns("a", time.Time{}); len(runs) != 1 || !runs[0].Custom {
+		t.Errorf("runs of a = %+v, want one custom run", runs)
+	}
+}
@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// record is one line of the log.
+type record struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+const (
+	kindPlayer       = "player"
+	kindCaroGame     = "caroGame"
+	kindSnakeRun     = "snakeRun"
+	kindGraphSession = "graphSession"
+)
+
+var (
+	errClosed    = errors.New("storage closed")
+	errQueueFull = errors.New("storage write queue full")
+)
+
+// File is a Storage backed by an append-only log of JSON lines, one per
+// saved record. The log is replayed into a Memory when it is opened, so
+// the profiles and each player's latest results are read without touching
+// the disk; only EachSnakeRun reads the whole log back.
+//
+// Saves only update memory and queue the record; a writer goroutine appends
+// it to the log, so games may save while holding their locks. If the disk
+// cannot keep up and queueSize records are waiting, further saves fail and
+// are counted as dropped. Write errors are logged, and Close waits for the
+// queue to be written.
+type File struct {
+	*Memory
+	f         *os.File
+	queueSize int
+	done      chan struct{} // closed when the writer returns
+
+	// writing is held while the writer takes the queue and writes it, so
+	// EachSnakeRun finds every record either in the log or in the queue.
+	writing sync.Mutex
+
+	mu      sync.Mutex
+	pending sync.Cond
+	queue   []byte // lines not written yet
+	queued  int    // records in queue
+	closed  bool
+}
+
+// OpenFile opens the log at path, creating it if needed, and replays it,
+// keeping history results of each kind per player in memory. At most
+// queueSize records wait to be written. A line that cannot be decoded,
+// such as one cut short by a crash, is skipped with a warning.
+func OpenFile(path string, history, queueSize int) (*File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &File{Memory: NewMemory(history), f: f, queueSize: queueSize, done: make(chan struct{})}
+	s.pending.L = &s.mu
+	if err := s.replay(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("replay %s: %w", path, err)
+	}
+	go s.writer()
+	return s, nil
+}
+
+// newScanner returns a scanner of the lines of a log.
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	return scanner
+}
+
+func (s *File) replay() error {
+	scanner := newScanner(s.f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := s.apply(scanner.Bytes()); err != nil {
+			slog.Warn("skipping storage record", "file", s.f.Name(), "line", line, "err", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// A record cut short has no newline; start the next one on its own line.
+	end, err := s.f.Seek(0, io.SeekEnd)
+	if err != nil || end == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := s.f.ReadAt(last, end-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		_, err = s.f.Write([]byte{'\n'})
+	}
+	return err
+}
+
+// apply adds one line of the log to memory.
+func (s *File) apply(line []byte) error {
+	var rec record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+	switch rec.Kind {
+	case kindPlayer:
+		var p Player
+		if err := json.Unmarshal(rec.Data, &p); err != nil {
+			return err
+		}
+		return s.Memory.SavePlayer(p)
+	case kindCaroGame:
+		var g CaroGame
+		if err := json.Unmarshal(rec.Data, &g); err != nil {
+			return err
+		}
+		return s.Memory.SaveCaroGame(g)
+	case kindSnakeRun:
+		var r SnakeRun
+		if err := json.Unmarshal(rec.Data, &r); err != nil {
+			return err
+		}
+		return s.Memory.SaveSnakeRun(r)
+	case kindGraphSession:
+		var gs GraphSession
+		if err := json.Unmarshal(rec.Data, &gs); err != nil {
+			return err
+		}
+		return s.Memory.SaveGraphSession(gs)
+	default:
+		return fmt.Errorf("unknown kind %q", rec.Kind)
+	}
+}
+
+// append queues one record for the writer.
+func (s *File) append(kind string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(record{Kind: kind, Data: data})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosed
+	}
+	if s.queued >= s.queueSize {
+		droppedRecords.Inc(kind)
+		return errQueueFull
+	}
+	s.queue = append(append(s.queue, line...), '\n')
+	s.queued++
+	s.pending.Signal()
+	return nil
+}
+
+// writer appends the queued records to the log until the File is closed
+// and the queue is empty.
+func (s *File) writer() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.pending.Wait()
+		}
+		empty := len(s.queue) == 0
+		s.mu.Unlock()
+		if empty {
+			return // closed
+		}
+		s.write()
+	}
+}
+
+// write appends the queued records to the log.
+func (s *File) write() {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+
+	s.mu.Lock()
+	lines := s.queue
+	s.queue, s.queued = nil, 0
+	s.mu.Unlock()
+
+	if _, err := s.f.Write(lines); err != nil {
+		slog.Error("write storage records", "file", s.f.Name(), "bytes", len(lines), "err", err)
+	}
+}
+
+// EachSnakeRun reads the runs back from the log, then from the records not
+// written yet. Lines that cannot be decoded were reported by the replay and
+// are skipped.
+func (s *File) EachSnakeRun(since time.Time, fn func(SnakeRun)) error {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+
+	s.mu.Lock()
+	queue := slices.Clone(s.queue)
+	s.mu.Unlock()
+
+	f, err := os.Open(s.f.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := newScanner(io.MultiReader(f, bytes.NewReader(queue)))
+	for scanner.Scan() {
+		var rec record
+		var r SnakeRun
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil || rec.Kind != kindSnakeRun || json.Unmarshal(rec.Data, &r) != nil {
+			continue
+		}
+		if !r.Ended.Before(since) {
+			fn(r)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *File) SavePlayer(p Player) error {
+	if err := s.append(kindPlayer, p); err != nil {
+		return err
+	}
+	return s.Memory.SavePlayer(p)
+}
+
+func (s *File) SaveCaroGame(g CaroGame) error {
+	if err := s.append(kindCaroGame, g); err != nil {
+		return err
+	}
+	return s.Memory.SaveCaroGame(g)
+}
+
+func (s *File) SaveSnakeRun(r SnakeRun) error {
+	if err := s.append(kindSnakeRun, r); err != nil {
+		return err
+	}
+	return s.Memory.SaveSnakeRun(r)
+}
+
+func (s *File) SaveGraphSession(gs GraphSession) error {
+	if err := s.append(kindGraphSession, gs); err != nil {
+		return err
+	}
+	return s.Memory.SaveGraphSession(gs)
+}
+
+// Close writes the queued records, flushes the log to disk and closes it.
+// Saving afterwards fails.
+func (s *File) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errClosed
+	}
+	s.closed = true
+	s.pending.Signal()
+	s.mu.Unlock()
+	<-s.done
+
+	if err := s.f.Sync(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// saveAll saves one record of every kind to s.
+func saveAll(t *testing.T, s Storage) {
+	t.Helper()
+	for _, err := range []error{
+		s.SavePlayer(Player{ID: "a", Name: "Alice", Created: epoch}),
+		s.SaveCaroGame(CaroGame{Room: "c1", Players: []CaroPlayer{{ID: "a", Mark: "X"}}, Result: "won", Winner: "a"}),
+		s.SaveSnakeRun(SnakeRun{Room: "s1", PlayerID: "a", Score: 4, Ended: epoch}),
+		s.SaveGraphSession(GraphSession{Room: "g1", PlayerID: "a", Score: 2}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkAll fails t unless s holds the records of saveAll.
+func checkAll(t *testing.T, s Storage) {
+	t.Helper()
+	if p, err := s.Player("a"); err != nil || p.Name != "Alice" || !p.Created.Equal(epoch) {
+		t.Errorf("Player(a) = %+v, %v", p, err)
+	}
+	if games, _ := s.CaroGames("a"); len(games) != 1 || games[0].Winner != "a" {
+		t.Errorf("CaroGames(a) = %+v", games)
+	}
+	if runs, _ := s.SnakeRuns("a", time.Time{}); len(runs) != 1 || runs[0].Score != 4 {
+		t.Errorf("SnakeRuns(a) = %+v", runs)
+	}
+	if sessions, _ := s.GraphSessions("a"); len(sessions) != 1 || sessions[0].Score != 2 {
+		t.Errorf("GraphSessions(a) = %+v", sessions)
+	}
+}
+
+func TestFileReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	s, err := OpenFile(path, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveAll(t, s)
+	// Reads do not wait for the writer.
+	checkAll(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SavePlayer(Player{ID: "b"}); !errors.Is(err, errClosed) {
+		t.Errorf("SavePlayer after Close: err = %v, want %v", err, errClosed)
+	}
+
+	s, err = OpenFile(path, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkAll(t, s)
+}
+
+func TestFileTruncatedLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	s, err := OpenFile(path, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveAll(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash cut the last record short.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"kind":"player","data":{"id":"b","na`)
+	f.Close()
+
+	s, err = OpenFile(path, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAll(t, s)
+	if _, err := s.Player("b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Player(b) of the cut record: err = %v, want ErrNotFound", err)
+	}
+	// The next record starts on a line of its own.
+	if err := s.SavePlayer(Player{ID: "c", Name: "Carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, `{"kind":"player","data":{"id":"c"`) {
+		t.Errorf("last line = %q, want the record of c", last)
+	}
+
+	s, err = OpenFile(path, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkAll(t, s)
+	if p, err := s.Player("c"); err != nil || p.Name != "Carol" {
+		t.Errorf("Player(c) = %+v, %v", p, err)
+	}
+}
+
+func TestFileSkipsBadLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	log := strings.Join([]string{
+		`{"kind":"player","data":{"id":"a","name":"Alice"}}`,
+		`not json`,
+		`{"kind":"unknown","data":{}}`,
+		``,
+		`{"kind":"snakeRun","data":{"playerId":"a","score":"four"}}`,
+		`{"kind":"snakeRun","data":{"playerId":"a","score":4}}`,
+	}, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenFile(path, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Player("a"); err != nil {
+		t.Errorf("Player(a): %v", err)
+	}
+	if runs, _ := s.SnakeRuns("a", time.Time{}); len(runs) != 1 || runs[0].Score != 4 {
+		t.Errorf("SnakeRuns(a) = %+v, want the one valid run", runs)
+	}
+}
+
+func TestFileEachSnakeRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	s, err := OpenFile(path, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		s.SaveSnakeRun(SnakeRun{PlayerID: "a", Score: i, Ended: epoch.Add(time.Duration(i) * time.Hour)})
+	}
+	// Memory keeps the latest run, the log all of them, written or not.
+	if runs, _ := s.SnakeRuns("a", time.Time{}); !slices.Equal(scores(runs), []int{2}) {
+		t.Errorf("SnakeRuns(a) scores = %v, want [2]", scores(runs))
+	}
+	var all []SnakeRun
+	if err := s.EachSnakeRun(epoch.Add(time.Hour), func(r SnakeRun) { all = append(all, r) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := scores(all); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("EachSnakeRun scores = %v, want [1 2]", got)
+	}
+	s.Close()
+}
+
+func TestFileQueueFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	s, err := OpenFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The writer cannot take the queue, as if the disk were stuck.
+	s.writing.Lock()
+	for i := range 2 {
+		if err := s.SaveSnakeRun(SnakeRun{PlayerID: "a", Score: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SaveSnakeRun(SnakeRun{PlayerID: "a", Score: 2}); !errors.Is(err, errQueueFull) {
+		t.Errorf("third save: err = %v, want %v", err, errQueueFull)
+	}
+	s.writing.Unlock()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if runs, _ := s.SnakeRuns("a", time.Time{}); !slices.Equal(scores(runs), []int{0, 1}) {
+		t.Errorf("SnakeRuns(a) scores = %v, want the two queued runs", scores(runs))
+	}
+}
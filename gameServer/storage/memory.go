@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Memory is a Storage that forgets everything on restart. It keeps every
+// player's profile but only their history latest results of each kind,
+// indexed by player.
+type Memory struct {
+	history int
+
+	mu            sync.RWMutex
+	players       map[string]Player
+	caroGames     map[string][]CaroGame // by player ID, each game under both players
+	snakeRuns     map[string][]SnakeRun
+	graphSessions map[string][]GraphSession
+}
+
+// NewMemory returns a Memory keeping history results of each kind per
+// player.
+func NewMemory(history int) *Memory {
+	return &Memory{
+		history:       history,
+		players:       make(map[string]Player),
+		caroGames:     make(map[string][]CaroGame),
+		snakeRuns:     make(map[string][]SnakeRun),
+		graphSessions: make(map[string][]GraphSession),
+	}
+}
+
+// keep appends v to the results of a player, forgetting the oldest ones
+// beyond history.
+func keep[T any](results []T, v T, history int) []T {
+	results = append(results, v)
+	if n := len(results) - history; n > 0 {
+		results = slices.Delete(results, 0, n)
+	}
+	return results
+}
+
+func (m *Memory) SavePlayer(p Player) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.players[p.ID] = p
+	return nil
+}
+
+func (m *Memory) Player(id string) (Player, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p, ok := m.players[id]
+	if !ok {
+		return Player{}, ErrNotFound
+	}
+	return p, nil
+}
+
+func (m *Memory) SaveCaroGame(g CaroGame) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g.Players = slices.Clone(g.Players)
+	for _, p := range g.Players {
+		m.caroGames[p.ID] = keep(m.caroGames[p.ID], g, m.history)
+	}
+	return nil
+}
+
+func (m *Memory) CaroGames(playerID string) ([]CaroGame, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	games := make([]CaroGame, 0, len(m.caroGames[playerID]))
+	for _, g := range m.caroGames[playerID] {
+		g.Players = slices.Clone(g.Players)
+		games = append(games, g)
+	}
+	return games, nil
+}
+
+func (m *Memory) SaveSnakeRun(r SnakeRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snakeRuns[r.PlayerID] = keep(m.snakeRuns[r.PlayerID], r, m.history)
+	return nil
+}
+
+func (m *Memory) SnakeRuns(playerID string, since time.Time) ([]SnakeRun, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	runs := []SnakeRun{}
+	for _, r := range m.snakeRuns[playerID] {
+		if !r.Ended.Before(since) {
+			runs = append(runs, r)
+		}
+	}
+	return runs, nil
+}
+
+// EachSnakeRun only sees the runs Memory still keeps.
+func (m *Memory) EachSnakeRun(since time.Time, fn func(SnakeRun)) error {
+	m.mu.RLock()
+	var runs []SnakeRun
+	for _, playerRuns := range m.snakeRuns {
+		for _, r := range playerRuns {
+			if !r.Ended.Before(since) {
+				runs = append(runs, r)
+			}
+		}
+	}
+	m.mu.RUnlock()
+
+	slices.SortStableFunc(runs, func(a, b SnakeRun) int { return a.Ended.Compare(b.Ended) })
+	for _, r := range runs {
+		fn(r)
+	}
+	return nil
+}
+
+func (m *Memory) SaveGraphSession(s GraphSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.graphSessions[s.PlayerID] = keep(m.graphSessions[s.PlayerID], s, m.history)
+	return nil
+}
+
+func (m *Memory) GraphSessions(playerID string) ([]GraphSession, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]GraphSession{}, m.graphSessions[playerID]...), nil
+}
+
+func (m *Memory) Close() error { return nil }
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func TestMemoryPlayer(t *testing.T) {
+	m := NewMemory(100)
+	if _, err := m.Player("p1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Player of unknown ID: err = %v, want ErrNotFound", err)
+	}
+	m.SavePlayer(Player{ID: "p1", Name: "old", Created: epoch})
+	m.SavePlayer(Player{ID: "p1", Name: "new", Created: epoch})
+	p, err := m.Player("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "new" {
+		t.Errorf("Name = %q, want the last saved %q", p.Name, "new")
+	}
+}
+
+func TestMemoryCaroGames(t *testing.T) {
+	m := NewMemory(100)
+	players := []CaroPlayer{{ID: "a", Mark: "X"}, {ID: "b", Mark: "O"}}
+	m.SaveCaroGame(CaroGame{Room: "r1", Players: players, Winner: "a", Result: "won"})
+	m.SaveCaroGame(CaroGame{Room: "r2", Players: []CaroPlayer{{ID: "b"}, {ID: "c"}}, Result: "abandoned"})
+	// The game keeps its own copy of the players it saved.
+	players[0].ID = "changed"
+
+	games, err := m.CaroGames("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 2 || games[0].Room != "r1" || games[1].Room != "r2" {
+		t.Fatalf("CaroGames(b) = %+v, want r1 then r2", games)
+	}
+	if games[0].Players[0].ID != "a" {
+		t.Errorf("saved players changed with the caller's slice: %+v", games[0].Players)
+	}
+	games[0].Players[0].ID = "changed"
+	if again, _ := m.CaroGames("a"); len(again) != 1 || again[0].Players[0].ID != "a" {
+		t.Errorf("stored players changed with a returned slice: %+v", again)
+	}
+
+	if games, _ := m.CaroGames("nobody"); games == nil || len(games) != 0 {
+		t.Errorf("CaroGames(nobody) = %#v, want an empty slice", games)
+	}
+}
+
+// scores returns the scores of runs.
+func scores(runs []SnakeRun) []int {
+	scores := []int{}
+	for _, r := range runs {
+		scores = append(scores, r.Score)
+	}
+	return scores
+}
+
+func TestMemorySnakeRuns(t *testing.T) {
+	m := NewMemory(100)
+	m.SaveSnakeRun(SnakeRun{PlayerID: "a", Score: 1, Ended: epoch})
+	m.SaveSnakeRun(SnakeRun{PlayerID: "b", Score: 2, Ended: epoch.Add(time.Hour)})
+	m.SaveSnakeRun(SnakeRun{PlayerID: "a", Score: 3, Ended: epoch.Add(2 * time.Hour)})
+
+	tests := []struct {
+		player string
+		since  time.Time
+		want   []int // scores
+	}{
+		{"a", time.Time{}, []int{1, 3}},
+		{"a", epoch.Add(time.Hour), []int{3}}, // since is inclusive
+		{"b", epoch.Add(2 * time.Hour), []int{}},
+		{"nobody", time.Time{}, []int{}},
+	}
+	for _, tt := range tests {
+		runs, err := m.SnakeRuns(tt.player, tt.since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := scores(runs); !slices.Equal(got, tt.want) {
+			t.Errorf("SnakeRuns(%q, %v) scores = %v, want %v", tt.player, tt.since, got, tt.want)
+		}
+	}
+
+	var all []SnakeRun
+	m.EachSnakeRun(epoch.Add(time.Hour), func(r SnakeRun) { all = append(all, r) })
+	if got := scores(all); !slices.Equal(got, []int{2, 3}) {
+		t.Errorf("EachSnakeRun scores = %v, want [2 3], oldest first", got)
+	}
+}
+
+func TestMemoryHistory(t *testing.T) {
+	m := NewMemory(2)
+	for i := range 3 {
+		m.SaveSnakeRun(SnakeRun{PlayerID: "a", Score: i, Ended: epoch})
+		m.SaveCaroGame(CaroGame{Players: []CaroPlayer{{ID: "a"}, {ID: "b"}}, Moves: i})
+		m.SaveGraphSession(GraphSession{PlayerID: "a", Score: i})
+	}
+	m.SaveSnakeRun(SnakeRun{PlayerID: "b", Score: 9, Ended: epoch})
+
+	if runs, _ := m.SnakeRuns("a", time.Time{}); !slices.Equal(scores(runs), []int{1, 2}) {
+		t.Errorf("SnakeRuns(a) scores = %v, want the latest two", scores(runs))
+	}
+	if runs, _ := m.SnakeRuns("b", time.Time{}); !slices.Equal(scores(runs), []int{9}) {
+		t.Errorf("SnakeRuns(b) scores = %v, want [9]", scores(runs))
+	}
+	for _, id := range []string{"a", "b"} {
+		if games, _ := m.CaroGames(id); len(games) != 2 || games[0].Moves != 1 || games[1].Moves != 2 {
+			t.Errorf("CaroGames(%s) = %+v, want the latest two", id, games)
+		}
+	}
+	if sessions, _ := m.GraphSessions("a"); len(sessions) != 2 || sessions[0].Score != 1 {
+		t.Errorf("GraphSessions(a) = %+v, want the latest two", sessions)
+	}
+}
+
+func TestMemoryGraphSessions(t *testing.T) {
+	m := NewMemory(100)
+	m.SaveGraphSession(GraphSession{Room: "r1", PlayerID: "a", Score: 5})
+	m.SaveGraphSession(GraphSession{Room: "r1", PlayerID: "b", Score: 7})
+	m.SaveGraphSession(GraphSession{Room: "r2", PlayerID: "a", Score: 9})
+
+	sessions, err := m.GraphSessions("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].Score != 5 || sessions[1].Score != 9 {
+		t.Errorf("GraphSessions(a) = %+v, want scores 5 then 9", sessions)
+	}
+}
@@ -0,0 +1,6 @@
+package storage
+
+import "github.com/simplegameserver/gameserver/metrics"
+
+var droppedRecords = metrics.NewCounter("gameserver_storage_dropped_records_total",
+	"Records not saved because the storage write queue was full, by kind.", "kind")
@@ -0,0 +1,12 @@
+package storage
+
+import "github.com/simplegameserver/gameserver/config"
+
+// Open returns the Storage configured by cfg: a File if cfg.Path is set,
+// otherwise a Memory.
+func Open(cfg config.Storage) (Storage, error) {
+	if cfg.Path == "" {
+		return NewMemory(cfg.History), nil
+	}
+	return OpenFile(cfg.Path, cfg.History, cfg.QueueSize)
+}
@@ -0,0 +1,99 @@
+// Package storage keeps what should outlive a restart: player profiles and
+// the results of finished caro games, snake runs and graph sessions. Games
+// write their results through a Storage when they happen; reads are for the
+// HTTP APIs.
+//
+// Memory keeps the profiles and each player's latest results in maps and is
+// meant for tests and local runs. File additionally appends every record to
+// a JSON log that is replayed when it is opened; older results are only
+// kept in the log.
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Storage is implemented by Memory and File. Its methods may be called from
+// any goroutine.
+type Storage interface {
+	// SavePlayer records a player's profile, replacing the previous one
+	// with the same ID.
+	SavePlayer(p Player) error
+	// Player returns the profile of a player, or ErrNotFound.
+	Player(id string) (Player, error)
+
+	// The results of a player are listed oldest first and only the latest
+	// ones are kept, see Memory.
+
+	SaveCaroGame(g CaroGame) error
+	// CaroGames returns the games playerID took part in.
+	CaroGames(playerID string) ([]CaroGame, error)
+
+	SaveSnakeRun(r SnakeRun) error
+	// SnakeRuns returns the runs of playerID that ended at or after since.
+	SnakeRuns(playerID string, since time.Time) ([]SnakeRun, error)
+	// EachSnakeRun calls fn with every run of every player that ended at or
+	// after since, oldest first. File reads them back from its log.
+	EachSnakeRun(since time.Time, fn func(SnakeRun)) error
+
+	SaveGraphSession(s GraphSession) error
+	// GraphSessions returns the sessions of playerID.
+	GraphSessions(playerID string) ([]GraphSession, error)
+
+	Close() error
+}
+
+// Player is the profile created when a player logs in.
+type Player struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// CaroPlayer is a player of a CaroGame and the mark they played.
+type CaroPlayer struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Mark string `json:"mark"`
+}
+
+// CaroGame is a finished caro game. Result is "won", "abandoned" or
+// "reset"; Winner is only set for "won".
+type CaroGame struct {
+	Room     string       `json:"room"`
+	Players  []CaroPlayer `json:"players"`
+	Winner   string       `json:"winner,omitempty"`
+	Result   string       `json:"result"`
+	Moves    int          `json:"moves"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+}
+
+// SnakeRun is one life of a snake, from its spawn until it hit a wall or
+// another snake ("collision") or its player left ("disconnect"). Custom
+// runs were played in a room with overridden rules.
+type SnakeRun struct {
+	Room     string    `json:"room"`
+	PlayerID string    `json:"playerId"`
+	Name     string    `json:"name"`
+	Score    int       `json:"score"`
+	Length   int       `json:"length"`
+	Reason   string    `json:"reason"`
+	Started  time.Time `json:"started"`
+	Ended    time.Time `json:"ended"`
+	Custom   bool      `json:"custom,omitempty"`
+}
+
+// GraphSession is the time a player spent in a graph match and the score
+// they left with.
+type GraphSession struct {
+	Room     string    `json:"room"`
+	PlayerID string    `json:"playerId"`
+	Name     string    `json:"name"`
+	Score    int       `json:"score"`
+	Joined   time.Time `json:"joined"`
+	Left     time.Time `json:"left"`
+}